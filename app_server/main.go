@@ -3,6 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -19,6 +25,69 @@ import (
 type registered_server struct {
 	URL string `json:"url"`
 	Port string `json:"port"`
+	Service string `json:"service"`
+}
+
+// Optional TLS and credentials, all from the environment:
+//   GATEWAY_URL                 the gateway's control listener, default http://localhost:9090
+//   TLS_CERT_FILE, TLS_KEY_FILE our certificate, for serving HTTPS and as the client certificate towards the gateway
+//   TLS_CA_FILE                 verifies the gateway, both as a server and as a client calling us
+//   GATEWAY_KEY_ID, GATEWAY_SECRET  signs registration calls, see control.hmac_keys in the gateway config
+//   GATEWAY_TOKEN               bearer token for registration calls instead, see control.tokens
+var gateway_url = env_or("GATEWAY_URL", "http://localhost:9090")
+var app_tls *tls.Config		// nil means plain HTTP
+var control_client = http.DefaultClient
+
+func env_or(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func load_tls() *tls.Config {
+	cert_file, key_file, ca_file := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CA_FILE")
+	if cert_file == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		log.Fatalf("Could not load the TLS certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if ca_file != "" {
+		pem, err := os.ReadFile(ca_file)
+		if err != nil {
+			log.Fatalf("Could not read the CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		config.RootCAs = pool	// Trust the gateway's server certificate
+		config.ClientCAs = pool	// Only the gateway may call us
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// POSTs to a gateway control endpoint, signed or with a token when we have credentials
+func control_post(path, content_type string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, gateway_url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	if key_id := os.Getenv("GATEWAY_KEY_ID"); key_id != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		sum := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, []byte(os.Getenv("GATEWAY_SECRET")))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(sum[:]))
+		req.Header.Set("X-Gateway-Key-Id", key_id)
+		req.Header.Set("X-Gateway-Timestamp", timestamp)
+		req.Header.Set("X-Gateway-Signature", hex.EncodeToString(mac.Sum(nil)))
+	} else if token := os.Getenv("GATEWAY_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return control_client.Do(req)
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -31,6 +100,24 @@ func loggingMiddleware(next http.Handler) http.Handler {
     })
 }
 
+// The gateway says how long it will wait for us in X-Request-Timeout, no point working past that
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget, err := time.ParseDuration(r.Header.Get("X-Request-Timeout"))
+		if err != nil {
+			next.ServeHTTP(w, r) // No deadline given
+			return
+		}
+		if budget <= 0 {
+			http.Error(w, "Deadline already passed", http.StatusGatewayTimeout)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func echoHandler(resp http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodPost{
 		http.Error(resp, "Cannot use this method, use POST", http.StatusMethodNotAllowed)
@@ -44,19 +131,30 @@ func echoHandler(resp http.ResponseWriter, request *http.Request) {
 	}
 	defer request.Body.Close()
 	// time.Sleep(2*time.Second)	// Simulates longer processing time
+	if request.Context().Err() != nil {
+		return	// Gateway gave up on us already
+	}
 
 	resp.Header().Set("Content-Type", "text/plain")	// The output is going to be of text type
 	resp.WriteHeader(http.StatusOK)
 	fmt.Fprint(resp, string(body))
 }
 
+func scheme() string {
+	if app_tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func register_server(server_port string) bool{
 	server_details := &registered_server{
 		Port: server_port,
-		URL: "http://localhost:"+server_port,
+		URL: scheme()+"://localhost:"+server_port,
+		Service: "echo",	// Gateway routes /echo to this pool
 	}
 	server_json, _ := json.Marshal(server_details)
-	resp, err := http.Post("http://localhost:8080/registerServer", "application/json", bytes.NewBuffer(server_json))
+	resp, err := control_post("/registerServer", "application/json", server_json)
 	if err != nil {
 		log.Fatalf("Could not register server %v",err)
 		return false
@@ -67,12 +165,17 @@ func register_server(server_port string) bool{
 		fmt.Println("Server already added")
 		return true
 	}
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(resp.Body)
+		log.Printf("[WARNING] Gateway refused the registration: %s %s", resp.Status, bytes.TrimSpace(reason))
+		return false
+	}
 	return true
 }
 
 func exit_gateway(server_port string) {
 	log.Println("Control-c detected turning off system.")
-	resp, err := http.Post("http://localhost:8080/exit", "text/plain", bytes.NewBuffer([]byte(server_port)))
+	resp, err := control_post("/exit", "text/plain", []byte(server_port))
 	if err != nil {
 		log.Fatal("Could not exit out of gateway cleanly.")
 	}
@@ -91,6 +194,11 @@ func main() {
 	signal_shutdown := make(chan os.Signal, 1)
 	signal.Notify(signal_shutdown, os.Interrupt, syscall.SIGTERM)	// Setting all triggers for a shutdown.
 
+	app_tls = load_tls()
+	if app_tls != nil {
+		control_client = &http.Client{Transport: &http.Transport{TLSClientConfig: app_tls}}	// Our certificate proves who is registering
+	}
+
 	server_port := "8081"
 	if !register_server(server_port){
 		log.Printf("[WARNING] Could not register server.")
@@ -129,10 +237,15 @@ func main() {
 			"app_server-healthCheck",
 		),
 	)	// Function that runs when endpoint is reached
-	wrapped := otelhttp.NewHandler(loggingMiddleware(mux), "gateway-root")
+	wrapped := otelhttp.NewHandler(loggingMiddleware(deadlineMiddleware(mux)), "gateway-root")
 	log.Printf("Server starting on port %s", server_port)
 	addr := fmt.Sprintf(":%s", server_port)
-	err = http.ListenAndServe(addr, wrapped)	// blocks and runs indefinitely
+	server := &http.Server{Addr: addr, Handler: wrapped, TLSConfig: app_tls}
+	if app_tls != nil {
+		err = server.ListenAndServeTLS("", "")	// blocks and runs indefinitely
+	} else {
+		err = server.ListenAndServe()	// blocks and runs indefinitely
+	}
 	if err != nil {
 		fmt.Println("There was an error starting the server", err)
 	}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bans clients that keep hitting the rate limit or failing authentication
+type ban_config struct {
+	Threshold int      `json:"threshold"` // Rate limited or unauthenticated requests within window that get a client banned, 0 turns banning off
+	Window    duration `json:"window"`
+	Duration  duration `json:"duration"` // How long a ban lasts
+	Exempt    []string `json:"exempt"`   // IPs or CIDRs that are never banned
+	exempt    []netip.Prefix
+}
+
+func (bc *ban_config) validate() error {
+	if bc.Threshold < 0 {
+		return errors.New("threshold can't be negative")
+	}
+	if bc.Threshold > 0 && (bc.Window <= 0 || bc.Duration <= 0) {
+		return errors.New("window and duration must be positive")
+	}
+	if _, err := parse_cidrs(bc.Exempt); err != nil {
+		return fmt.Errorf("exempt: %w", err)
+	}
+	return nil
+}
+
+// Parses the IP lists of every route and of auto_ban. validate reports bad entries.
+func (c *gateway_config) fill_ip_rules() {
+	for i := range c.Routes {
+		rt := &c.Routes[i]
+		rt.allow, _ = parse_cidrs(rt.AllowIPs)
+		rt.deny, _ = parse_cidrs(rt.DenyIPs)
+	}
+	c.AutoBan.exempt, _ = parse_cidrs(c.AutoBan.Exempt)
+}
+
+// Deny list first, then the allow list when the route has one. Writes a 403 and returns false
+// when the client may not use the route.
+func ip_allowed(w http.ResponseWriter, r *http.Request, rt *route) bool {
+	ip := client_ip(r)
+	reason := ""
+	switch {
+	case contains_ip(rt.deny, ip):
+		reason = "deny_list"
+	case len(rt.allow) > 0 && !contains_ip(rt.allow, ip):
+		reason = "allow_list"
+	default:
+		return true
+	}
+	access_denied.Add(reason, 1)
+	log.Printf("[WARNING] %s refused for %s by the route's %s", ip, r.URL.Path, reason)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// Writes a 403 and returns false while the client is banned
+func not_banned(w http.ResponseWriter, r *http.Request) bool {
+	left := bans.remaining(client_ip(r), time.Now())
+	if left <= 0 {
+		return true
+	}
+	access_denied.Add("banned", 1)
+	w.Header().Set("Retry-After", header_seconds(left))
+	http.Error(w, "Banned for too many rate limited or unauthenticated requests", http.StatusForbidden)
+	return false
+}
+
+type ban_state struct {
+	strikes      int
+	window_start time.Time
+	banned_until time.Time
+}
+
+// Rate limit strikes and bans per client IP. Only kept in this gateway's memory.
+type ban_tracker struct {
+	mu      sync.Mutex
+	clients map[string]*ban_state
+}
+
+var bans = &ban_tracker{clients: make(map[string]*ban_state)}
+
+// Clients tracked before stale entries get swept out
+const max_ban_entries = 100000
+
+// Counts a rate limited or unauthenticated request. Bans the client once it reaches the threshold within the window.
+func (bt *ban_tracker) strike(ip string, bc *ban_config, now time.Time) {
+	if bc.Threshold == 0 || contains_ip(bc.exempt, ip) {
+		return
+	}
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if len(bt.clients) >= max_ban_entries {
+		bt.sweep(time.Duration(bc.Window), now)
+	}
+	state := bt.clients[ip]
+	if state == nil {
+		state = &ban_state{}
+		bt.clients[ip] = state
+	}
+	if now.Sub(state.window_start) > time.Duration(bc.Window) {
+		state.strikes, state.window_start = 0, now
+	}
+	state.strikes++
+	if state.strikes >= bc.Threshold && now.After(state.banned_until) {
+		state.banned_until = now.Add(time.Duration(bc.Duration))
+		state.strikes = 0
+		ip_bans.Add(1)
+		log.Printf("[WARNING] Banned %s for %s after %d rate limited or unauthenticated requests", ip, time.Duration(bc.Duration), bc.Threshold)
+	}
+}
+
+// Drops clients that are neither banned nor in a window anymore. Called with mu held.
+func (bt *ban_tracker) sweep(window time.Duration, now time.Time) {
+	for ip, state := range bt.clients {
+		if now.After(state.banned_until) && now.Sub(state.window_start) > window {
+			delete(bt.clients, ip)
+		}
+	}
+}
+
+// How much longer the client stays banned, 0 if it isn't
+func (bt *ban_tracker) remaining(ip string, now time.Time) time.Duration {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if state := bt.clients[ip]; state != nil && now.Before(state.banned_until) {
+		return state.banned_until.Sub(now)
+	}
+	return 0
+}
+
+// Ends a ban early, false if the client wasn't banned
+func (bt *ban_tracker) lift(ip string, now time.Time) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	state := bt.clients[ip]
+	if state == nil || !now.Before(state.banned_until) {
+		return false
+	}
+	delete(bt.clients, ip)
+	return true
+}
+
+// What /admin/bans reports for each banned client
+type ban_status struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+func (bt *ban_tracker) active(now time.Time) []ban_status {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	list := []ban_status{}
+	for ip, state := range bt.clients {
+		if now.Before(state.banned_until) {
+			list = append(list, ban_status{IP: ip, Until: state.banned_until})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
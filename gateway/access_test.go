@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		peer  string
+		want  bool
+	}{
+		{"no lists", nil, nil, "203.0.113.7:5000", true},
+		{"on the allow list", []string{"203.0.113.0/24"}, nil, "203.0.113.7:5000", true},
+		{"off the allow list", []string{"203.0.113.0/24"}, nil, "198.51.100.1:5000", false},
+		{"on the deny list", nil, []string{"203.0.113.7"}, "203.0.113.7:5000", false},
+		{"off the deny list", nil, []string{"203.0.113.7"}, "203.0.113.8:5000", true},
+		{"deny wins over allow", []string{"203.0.113.0/24"}, []string{"203.0.113.7"}, "203.0.113.7:5000", false},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:5000", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := default_config()
+			conf.Routes = []route{{Prefix: "/", AllowIPs: tt.allow, DenyIPs: tt.deny}}
+			conf.fill_ip_rules()
+			use_config(t, conf)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			w := httptest.NewRecorder()
+			if got := ip_allowed(w, r, &conf.Routes[0]); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Fatalf("got status %d, want 403", w.Code)
+			}
+		})
+	}
+}
+
+// A strike from ip, or with check set a look at how long ip stays banned, at an offset from the start
+type ban_step struct {
+	at     time.Duration
+	ip     string
+	check  bool
+	banned time.Duration // What remaining should say
+}
+
+func TestAutoBan(t *testing.T) {
+	bc := ban_config{Threshold: 3, Window: duration(time.Minute), Duration: duration(10 * time.Minute), Exempt: []string{"10.0.0.0/8"}}
+	const client = "203.0.113.7"
+	strike := func(at time.Duration) ban_step { return ban_step{at: at, ip: client} }
+	check := func(at, banned time.Duration) ban_step {
+		return ban_step{at: at, ip: client, check: true, banned: banned}
+	}
+	tests := []struct {
+		name  string
+		steps []ban_step
+	}{
+		{"threshold bans", []ban_step{strike(0), strike(time.Second), check(time.Second, 0), strike(2 * time.Second), check(2*time.Second, 10*time.Minute)}},
+		{"strikes outside the window don't add up", []ban_step{strike(0), strike(time.Second), strike(2 * time.Minute), check(2*time.Minute, 0)}},
+		{"ban runs out", []ban_step{strike(0), strike(0), strike(0), check(10*time.Minute-time.Second, time.Second), check(10*time.Minute, 0)}},
+		{"strikes while banned don't extend it", []ban_step{strike(0), strike(0), strike(0), strike(time.Minute), strike(time.Minute), strike(time.Minute), check(time.Minute, 9*time.Minute)}},
+		{"other clients aren't banned", []ban_step{strike(0), strike(0), strike(0), {ip: "203.0.113.8", check: true}}},
+		{"exempt clients are never banned", []ban_step{{ip: "10.1.2.3"}, {ip: "10.1.2.3"}, {ip: "10.1.2.3"}, {ip: "10.1.2.3", check: true}}},
+	}
+	start := time.Date(2024, time.January, 15, 10, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := default_config()
+			conf.AutoBan = bc
+			conf.fill_ip_rules()
+			bt := &ban_tracker{clients: make(map[string]*ban_state)}
+			for i, step := range tt.steps {
+				now := start.Add(step.at)
+				if !step.check {
+					bt.strike(step.ip, &conf.AutoBan, now)
+					continue
+				}
+				if got := bt.remaining(step.ip, now); got != step.banned {
+					t.Fatalf("step %d: %s banned for %s, want %s", i, step.ip, got, step.banned)
+				}
+			}
+		})
+	}
+}
+
+func TestTurnedOffBanning(t *testing.T) {
+	bt := &ban_tracker{clients: make(map[string]*ban_state)}
+	now := time.Now()
+	for range 10 {
+		bt.strike("203.0.113.7", &ban_config{}, now)
+	}
+	if bt.remaining("203.0.113.7", now) != 0 {
+		t.Fatal("banned with a threshold of 0")
+	}
+}
+
+func TestBannedClient(t *testing.T) {
+	fresh_bans(t)
+	use_config(t, default_config())
+	now := time.Now()
+	bans.strike("203.0.113.7", &ban_config{Threshold: 1, Window: duration(time.Minute), Duration: duration(time.Minute)}, now)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:5000"
+	w := httptest.NewRecorder()
+	if not_banned(w, r) || w.Code != http.StatusForbidden || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("banned client got through or no Retry-After: status %d", w.Code)
+	}
+	if len(bans.active(now)) != 1 || !bans.lift("203.0.113.7", now) || bans.lift("203.0.113.7", now) {
+		t.Fatal("ban not listed or not lifted exactly once")
+	}
+	if !not_banned(httptest.NewRecorder(), r) {
+		t.Fatal("lifted ban still applies")
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What /admin/upstreams reports for each server
+type server_status struct {
+	URL          string    `json:"url"`
+	Port         string    `json:"port"`
+	Static       bool      `json:"static"`
+	Owner        string    `json:"owner,omitempty"`
+	InQueue      int       `json:"in_queue"`
+	Weight       int       `json:"weight"`
+	Effective    float64   `json:"effective_weight"` // Below weight while slow start is ramping up
+	Zone         string    `json:"zone,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	LatencyMs    float64   `json:"latency_ewma_ms"`
+	Alive        bool      `json:"alive"`
+	LastChecked  int64     `json:"last_checked"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+	Ejections    int       `json:"ejections"`
+	Circuit      string    `json:"circuit"`
+}
+
+func snapshot_server(p *upstream_pool, s *server_struct) server_status {
+	p.mu.Lock()
+	in_queue, weight, effective, latency := s.in_queue, max(s.weight, 1), s.effective_weight(), s.latency_ewma
+	p.mu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := server_status{
+		URL:         s.URL,
+		Port:        s.port,
+		Static:      s.static,
+		Owner:       s.owner,
+		InQueue:     in_queue,
+		Weight:      weight,
+		Effective:   effective,
+		Zone:        s.zone,
+		Version:     s.version,
+		Tags:        s.tags,
+		LatencyMs:   latency,
+		Alive:       s.alive,
+		LastChecked: s.last_updated,
+		Ejected:     s.is_ejected(time.Now()),
+		Ejections:   s.outlier.ejections,
+		Circuit:     s.circuit.phase.String(),
+	}
+	if status.Ejected {
+		status.EjectedUntil = s.outlier.ejected_until
+	}
+	return status
+}
+
+// Lists every pool with the health and ejection state of its servers
+func upstreamsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Use GET for /admin/upstreams", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := control_admin(w, req); !ok {
+		return
+	}
+	result := make(map[string][]server_status)
+	for _, p := range all_pools() {
+		list := []server_status{}
+		for _, s := range p.members() {
+			list = append(list, snapshot_server(p, s))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+		result[p.name] = list
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Which rate limit store is in use and, for the memory one, how many keys it holds right now
+func rateLimitsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Use GET for /admin/ratelimits", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := control_admin(w, req); !ok {
+		return
+	}
+	active := current_rate_store()
+	result := map[string]any{"type": active.settings.Type}
+	if m, ok := active.store.(*memory_store); ok {
+		result["keys"] = m.size()
+		result["max_keys"] = active.settings.MaxKeys
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// What /admin/pools reports for each pool's concurrency limiting
+type pool_status struct {
+	InFlight      int     `json:"in_flight"`
+	Queued        int     `json:"queued"`
+	Limit         int     `json:"limit"` // 0 is unlimited
+	AdaptiveLimit float64 `json:"adaptive_limit,omitempty"`
+	PerServer     int     `json:"max_concurrent_per_server"`
+	QueueSize     int     `json:"queue_size"`
+}
+
+// In flight and queued requests per pool, plus the gateway wide count
+func poolsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Use GET for /admin/pools", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := control_admin(w, req); !ok {
+		return
+	}
+	pools := make(map[string]pool_status)
+	for _, p := range all_pools() {
+		p.mu.Lock()
+		status := pool_status{
+			InFlight:  p.inflight,
+			Queued:    p.queue.Len(),
+			Limit:     p.pool_limit(),
+			PerServer: p.limits.MaxConcurrentPerServer,
+			QueueSize: p.limits.QueueSize,
+		}
+		if p.adaptive != nil {
+			status.AdaptiveLimit = p.adaptive.limit
+		}
+		p.mu.Unlock()
+		pools[p.name] = status
+	}
+	result := map[string]any{
+		"gateway_in_flight": gateway_inflight.Load(),
+		"gateway_limit":     cfg().MaxConcurrentRequests,
+		"pools":             pools,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// What /admin/circuits reports for each server
+type circuit_status struct {
+	URL     string               `json:"url"`
+	Port    string               `json:"port"`
+	State   string               `json:"state"`
+	Since   time.Time            `json:"since,omitzero"`
+	History []circuit_transition `json:"history"`
+}
+
+// Circuit breaker state per pool, with each server's most recent transitions
+func circuitsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Use GET for /admin/circuits", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := control_admin(w, req); !ok {
+		return
+	}
+	result := make(map[string][]circuit_status)
+	for _, p := range all_pools() {
+		list := []circuit_status{}
+		for _, s := range p.members() {
+			s.mu.RLock()
+			list = append(list, circuit_status{
+				URL:     s.URL,
+				Port:    s.port,
+				State:   s.circuit.phase.String(),
+				Since:   s.circuit.changed,
+				History: append([]circuit_transition{}, s.circuit.history...),
+			})
+			s.mu.RUnlock()
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+		result[p.name] = list
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// What /admin/consumers reports for each consumer. Keys only show their prefix.
+type consumer_status struct {
+	ID           string        `json:"id"`
+	Managed      bool          `json:"managed"` // Created through this API, otherwise only seen through another authenticator
+	Plan         string        `json:"plan,omitempty"`
+	Keys         []key_status  `json:"keys,omitempty"`
+	Created      time.Time     `json:"created,omitzero"`
+	Usage        usage_counter `json:"usage"`
+	DailyLimit   int64         `json:"daily_limit"`   // 0 is unlimited
+	MonthlyLimit int64         `json:"monthly_limit"` // Same
+}
+
+type key_status struct {
+	Prefix  string    `json:"prefix"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func snapshot_consumer(conf *gateway_config, id string) (consumer_status, bool) {
+	consumer_db.mu.Lock()
+	mc, managed := consumer_db.consumers[id]
+	u, used := consumer_db.usage[id]
+	status := consumer_status{ID: id, Managed: managed}
+	if managed {
+		status.Created = mc.Created
+		for _, k := range mc.Keys {
+			status.Keys = append(status.Keys, key_status{Prefix: k.Prefix, Created: k.Created, Expires: k.Expires})
+		}
+	}
+	if used {
+		status.Usage = *u
+	}
+	consumer_db.mu.Unlock()
+	if !managed && !used {
+		return status, false
+	}
+	name, plan := conf.plan_for(id)
+	status.Plan = name
+	if plan != nil {
+		status.DailyLimit, status.MonthlyLimit = plan.Daily, plan.Monthly
+	}
+	return status, true
+}
+
+// Request body for creating and updating consumers
+type consumer_request struct {
+	ID   string `json:"id"`
+	Plan string `json:"plan"`
+}
+
+// Consumer ids end up in headers, logs and URLs, so keep them plain
+func valid_consumer_id(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func write_json(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// GET lists consumers with their usage, POST {"id", "plan"} creates one and returns its first key
+func consumersHandler(w http.ResponseWriter, req *http.Request) {
+	conf := cfg()
+	switch req.Method {
+	case http.MethodGet:
+		if _, ok := control_admin(w, req); !ok {
+			return
+		}
+		consumer_db.mu.Lock()
+		ids := []string{}
+		for id := range consumer_db.consumers {
+			ids = append(ids, id)
+		}
+		for id := range consumer_db.usage {
+			if _, managed := consumer_db.consumers[id]; !managed {
+				ids = append(ids, id)
+			}
+		}
+		consumer_db.mu.Unlock()
+		sort.Strings(ids)
+		list := []consumer_status{}
+		for _, id := range ids {
+			if status, ok := snapshot_consumer(conf, id); ok {
+				list = append(list, status)
+			}
+		}
+		write_json(w, http.StatusOK, list)
+	case http.MethodPost:
+		caller, ok := control_admin(w, req)
+		if !ok {
+			return
+		}
+		var body consumer_request
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || !valid_consumer_id(body.ID) {
+			http.Error(w, "Need an id made of letters, digits and -_.@", http.StatusBadRequest)
+			return
+		}
+		entry := audit_entry{Action: "create_consumer", Consumer: body.ID}
+		if _, known := conf.Plans[body.Plan]; body.Plan != "" && !known {
+			http.Error(w, fmt.Sprintf("Unknown plan %q", body.Plan), http.StatusBadRequest)
+			return
+		}
+		key, err := consumer_db.create(body.ID, body.Plan, time.Now())
+		if err != nil {
+			entry.Outcome, entry.Reason = "rejected", err.Error()
+			audit(req, caller, entry)
+			http.Error(w, "Consumer already exists", http.StatusConflict)
+			return
+		}
+		entry.Outcome = "ok"
+		audit(req, caller, entry)
+		log.Printf("Created consumer %s on plan %q", body.ID, body.Plan)
+		write_json(w, http.StatusCreated, map[string]string{"id": body.ID, "plan": body.Plan, "key": key})
+	default:
+		http.Error(w, "Use GET or POST for /admin/consumers", http.StatusMethodNotAllowed)
+	}
+}
+
+// /admin/consumers/<id>: GET shows one consumer, PATCH {"plan"} moves it to another plan, DELETE
+// removes it. POST /admin/consumers/<id>/keys {"grace": "24h"} issues a new key, the old ones keep
+// working for the grace period.
+func consumerHandler(w http.ResponseWriter, req *http.Request) {
+	conf := cfg()
+	rest := strings.TrimPrefix(req.URL.Path, "/admin/consumers/")
+	id, action, _ := strings.Cut(rest, "/")
+	if !valid_consumer_id(id) || (action != "" && action != "keys") {
+		http.NotFound(w, req)
+		return
+	}
+	caller, ok := control_admin(w, req)
+	if !ok {
+		return
+	}
+	if req.Method == http.MethodGet && action == "" {
+		status, ok := snapshot_consumer(conf, id)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		write_json(w, http.StatusOK, status)
+		return
+	}
+
+	entry := audit_entry{Consumer: id}
+	var err error
+	switch {
+	case action == "" && req.Method == http.MethodPatch:
+		entry.Action = "update_consumer"
+		var body consumer_request
+		if json.NewDecoder(req.Body).Decode(&body) != nil {
+			http.Error(w, "Could not read the JSON body", http.StatusBadRequest)
+			return
+		}
+		if _, known := conf.Plans[body.Plan]; body.Plan != "" && !known {
+			http.Error(w, fmt.Sprintf("Unknown plan %q", body.Plan), http.StatusBadRequest)
+			return
+		}
+		if err = consumer_db.set_plan(id, body.Plan); err == nil {
+			log.Printf("Consumer %s moved to plan %q", id, body.Plan)
+		}
+	case action == "" && req.Method == http.MethodDelete:
+		entry.Action = "delete_consumer"
+		if err = consumer_db.remove(id); err == nil {
+			log.Printf("Deleted consumer %s", id)
+		}
+	case action == "keys" && req.Method == http.MethodPost:
+		entry.Action = "rotate_key"
+		var body struct {
+			Grace duration `json:"grace"`
+		}
+		if req.ContentLength != 0 && json.NewDecoder(req.Body).Decode(&body) != nil {
+			http.Error(w, "Could not read the JSON body", http.StatusBadRequest)
+			return
+		}
+		var key string
+		if key, err = consumer_db.rotate(id, time.Duration(body.Grace), time.Now()); err == nil {
+			entry.Outcome = "ok"
+			audit(req, caller, entry)
+			log.Printf("Rotated the key of consumer %s, old keys valid for %s", id, time.Duration(body.Grace))
+			write_json(w, http.StatusCreated, map[string]string{"id": id, "key": key})
+			return
+		}
+	default:
+		http.Error(w, "Use GET, PATCH or DELETE on a consumer, POST on its keys", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		entry.Outcome, entry.Reason = "rejected", err.Error()
+		audit(req, caller, entry)
+		http.NotFound(w, req)
+		return
+	}
+	entry.Outcome = "ok"
+	audit(req, caller, entry)
+	status, _ := snapshot_consumer(conf, id)
+	write_json(w, http.StatusOK, status)
+}
+
+// GET lists the clients banned by auto_ban, DELETE /admin/bans?ip=<ip> lifts a ban early
+func bansHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if _, ok := control_admin(w, req); !ok {
+			return
+		}
+		write_json(w, http.StatusOK, bans.active(time.Now()))
+	case http.MethodDelete:
+		caller, ok := control_admin(w, req)
+		if !ok {
+			return
+		}
+		ip := req.URL.Query().Get("ip")
+		entry := audit_entry{Action: "lift_ban", Reason: ip}
+		if !bans.lift(ip, time.Now()) {
+			entry.Outcome = "rejected"
+			audit(req, caller, entry)
+			http.Error(w, fmt.Sprintf("%q is not banned", ip), http.StatusNotFound)
+			return
+		}
+		entry.Outcome = "ok"
+		audit(req, caller, entry)
+		log.Printf("Lifted the ban on %s", ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Use GET or DELETE for /admin/bans", http.StatusMethodNotAllowed)
+	}
+}
+
+// /debug/vars shows the command line and gateway counters, it needs the same admin as /admin/*
+func controlReadHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := control_admin(w, req); !ok {
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Named authenticators that routes refer to with "auth": ["name", ...]. A request passes if any
+// of the route's authenticators accepts it.
+type authenticator_config struct {
+	Type string `json:"type"` // api_key, consumers, jwt, introspection or basic
+
+	// api_key: key -> consumer, read from X-API-Key or the api_key query parameter.
+	// consumers takes the same header but checks keys issued through /admin/consumers.
+	Keys map[string]string `json:"keys"`
+
+	// basic: user -> password, either plain or "sha256:<hex>"
+	Users map[string]string `json:"users"`
+	Realm string            `json:"realm"`
+
+	// jwt: exactly one of secret (HS*), jwks_file or jwks_url
+	Secret        string   `json:"secret"`
+	JWKSFile      string   `json:"jwks_file"`
+	JWKSURL       string   `json:"jwks_url"`
+	JWKSCacheTTL  duration `json:"jwks_cache_ttl"` // Default 5m
+	Algorithms    []string `json:"algorithms"`     // Default HS256 with a secret, RS256 and ES256 otherwise
+	Issuer        string   `json:"issuer"`
+	Audience      string   `json:"audience"`
+	Leeway        duration `json:"leeway"` // Clock skew allowed on exp and nbf
+	RequireExp    bool     `json:"require_exp"`
+	ConsumerClaim string   `json:"consumer_claim"` // Claim naming the consumer, default sub
+
+	// introspection: opaque bearer tokens checked with an RFC 7662 endpoint, consumer_claim applies too
+	IntrospectionURL string   `json:"introspection_url"`
+	ClientID         string   `json:"client_id"` // Basic auth towards the endpoint, if it wants any
+	ClientSecret     string   `json:"client_secret"`
+	CacheTTL         duration `json:"cache_ttl"`          // How long an active answer is reused, default 1m, never past the token's exp
+	NegativeCacheTTL duration `json:"negative_cache_ttl"` // Same for inactive tokens, default 10s
+}
+
+// Whoever a request was authenticated as
+type consumer struct {
+	ID            string
+	Authenticator string
+	Claims        map[string]any // jwt and introspection only
+}
+
+type authenticator interface {
+	// err_no_credentials when the request carries nothing this authenticator understands,
+	// err_auth_unavailable when it can't tell because something it depends on is down
+	authenticate(r *http.Request) (*consumer, error)
+}
+
+var err_no_credentials = errors.New("no credentials")
+var err_auth_unavailable = errors.New("authorization server unavailable")
+
+func new_authenticator(ac authenticator_config) (authenticator, error) {
+	switch ac.Type {
+	case "api_key":
+		if len(ac.Keys) == 0 {
+			return nil, errors.New("api_key needs keys")
+		}
+		return &api_key_authenticator{keys: ac.Keys}, nil
+	case "consumers":
+		return managed_key_authenticator{}, nil
+	case "basic":
+		if len(ac.Users) == 0 {
+			return nil, errors.New("basic needs users")
+		}
+		return &basic_authenticator{users: ac.Users}, nil
+	case "jwt":
+		return new_jwt_authenticator(ac)
+	case "introspection":
+		return new_introspection_authenticator(ac)
+	}
+	return nil, fmt.Errorf("unknown authenticator type %q", ac.Type)
+}
+
+// Builds every authenticator once per config. validate reports the errors.
+func (c *gateway_config) fill_authenticators() {
+	c.authenticators = make(map[string]authenticator)
+	c.authenticator_errs = nil
+	for name, ac := range c.Authenticators {
+		a, err := new_authenticator(ac)
+		if err != nil {
+			c.authenticator_errs = append(c.authenticator_errs, fmt.Errorf("authenticators.%s: %w", name, err))
+			continue
+		}
+		c.authenticators[name] = a
+	}
+}
+
+// Authenticators whose settings didn't change carry over a reload, so their caches do too
+func (c *gateway_config) keep_authenticators(previous *gateway_config) {
+	for name, ac := range c.Authenticators {
+		if a, ok := previous.authenticators[name]; ok && reflect.DeepEqual(previous.Authenticators[name], ac) {
+			c.authenticators[name] = a
+		}
+	}
+}
+
+type api_key_authenticator struct {
+	keys map[string]string
+}
+
+func (a *api_key_authenticator) authenticate(r *http.Request) (*consumer, error) {
+	key := api_key(r)
+	if key == "" {
+		return nil, err_no_credentials
+	}
+	for known, id := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+			return &consumer{ID: id}, nil
+		}
+	}
+	return nil, errors.New("unknown API key")
+}
+
+type basic_authenticator struct {
+	users map[string]string
+}
+
+func (a *basic_authenticator) authenticate(r *http.Request) (*consumer, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, err_no_credentials
+	}
+	stored, known := a.users[user]
+	if !known || !password_matches(stored, password) {
+		return nil, errors.New("bad username or password")
+	}
+	return &consumer{ID: user}, nil
+}
+
+func password_matches(stored, password string) bool {
+	if hashed, ok := strings.CutPrefix(stored, "sha256:"); ok {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(hashed))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// Challenges for a 401, one per scheme the route accepts. A bearer token that was presented and
+// rejected gets error="invalid_token" as RFC 6750 asks.
+func (c *gateway_config) auth_challenges(names []string, bad_token bool) []string {
+	var challenges []string
+	for _, name := range names {
+		challenge := ""
+		switch ac := c.Authenticators[name]; ac.Type {
+		case "basic":
+			realm := ac.Realm
+			if realm == "" {
+				realm = "gateway"
+			}
+			challenge = fmt.Sprintf("Basic realm=%q", realm)
+		case "jwt", "introspection":
+			challenge = "Bearer"
+			if bad_token {
+				challenge = `Bearer error="invalid_token"`
+			}
+		case "api_key", "consumers":
+			challenge = `ApiKey header="X-API-Key"`
+		}
+		if !slices.Contains(challenges, challenge) {
+			challenges = append(challenges, challenge)
+		}
+	}
+	return challenges
+}
+
+// Runs the route's authenticators. On success the consumer goes into the request context, the
+// request log and the span. Otherwise it writes a 401, or a 503 when an authenticator that could
+// have accepted the request couldn't reach its server, and returns nil.
+func authenticate(w http.ResponseWriter, r *http.Request, conf *gateway_config, rt *route) *http.Request {
+	if len(rt.Auth) == 0 {
+		return r // Open route
+	}
+	var reason, unavailable error = err_no_credentials, nil
+	for _, name := range rt.Auth {
+		c, err := conf.authenticators[name].authenticate(r)
+		if errors.Is(err, err_no_credentials) {
+			continue
+		}
+		if errors.Is(err, err_auth_unavailable) {
+			unavailable = err
+			continue
+		}
+		if err != nil {
+			reason = err
+			continue // Another authenticator may still accept it
+		}
+		c.Authenticator = name
+		if info := request_info_from(r.Context()); info != nil {
+			info.consumer = c.ID
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", c.ID), attribute.String("auth.method", name))
+		return r.WithContext(context.WithValue(r.Context(), consumer_key{}, c))
+	}
+	if unavailable != nil {
+		// Not the client's fault, so no strike and no invalid_token
+		log.Printf("[ERROR] Can't authenticate %s from %s: %v", r.URL.Path, client_ip(r), unavailable)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return nil
+	}
+	log.Printf("Authentication failed for %s from %s: %v", r.URL.Path, client_ip(r), reason)
+	bans.strike(client_ip(r), &conf.AutoBan, time.Now())
+	for _, challenge := range conf.auth_challenges(rt.Auth, bearer_token(r) != "") {
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return nil
+}
+
+// Checks the route's scopes and claims against the consumer. Writes a 403 and returns false when
+// something is missing.
+func authorize(w http.ResponseWriter, r *http.Request, conf *gateway_config, rt *route) bool {
+	if len(rt.Scopes) == 0 && len(rt.Claims) == 0 {
+		return true
+	}
+	c := current_consumer(r.Context())
+	granted := c.scopes()
+	for _, scope := range rt.Scopes {
+		if !slices.Contains(granted, scope) {
+			log.Printf("[WARNING] %s lacks scope %q for %s", c.ID, scope, r.URL.Path)
+			if ac := conf.Authenticators[c.Authenticator]; ac.Type == "jwt" || ac.Type == "introspection" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(rt.Scopes, " ")))
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	for claim, want := range rt.Claims {
+		if !claim_has(c.Claims[claim], want) {
+			log.Printf("[WARNING] %s has no %s=%q for %s", c.ID, claim, want, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// Scopes from the OAuth2 "scope" claim (space separated) or the "scp" claim some issuers use
+func (c *consumer) scopes() []string {
+	var scopes []string
+	for _, claim := range []string{"scope", "scp"} {
+		switch v := c.Claims[claim].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []any:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+// A string claim must equal want, an array claim must contain it. Numbers and bools compare by
+// their JSON text.
+func claim_has(value any, want string) bool {
+	switch v := value.(type) {
+	case []any:
+		return slices.ContainsFunc(v, func(item any) bool { return claim_has(item, want) })
+	case string:
+		return v == want
+	case nil:
+		return false
+	}
+	return fmt.Sprint(value) == want
+}
+
+// Access control in front of the proxy: bans, the route's IP lists, the auth_rate_limit policy,
+// authentication and authorization. The matched route travels in the context so proxyHandler
+// works with the same config and route the checks used.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !not_banned(w, r) {
+			return
+		}
+		conf := cfg()
+		rt := match_route(conf, r)
+		if rt == nil {
+			next.ServeHTTP(w, r) // proxyHandler answers the 404
+			return
+		}
+		m := routed{conf: conf, rt: rt}
+		if len(rt.Auth) > 0 {
+			m.limited = conf.RateLimits[conf.AuthRateLimit]
+		}
+		r = r.WithContext(context.WithValue(r.Context(), routed_key{}, m))
+		if !ip_allowed(w, r, rt) {
+			return
+		}
+		if !rate_limiter(w, r, rt, m.limited) {
+			return
+		}
+		if r = authenticate(w, r, conf, rt); r == nil {
+			return
+		}
+		if !authorize(w, r, conf, rt) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type consumer_key struct{}
+
+// Authenticated consumer of the request, nil on open routes
+func current_consumer(ctx context.Context) *consumer {
+	c, _ := ctx.Value(consumer_key{}).(*consumer)
+	return c
+}
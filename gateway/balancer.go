@@ -0,0 +1,326 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Picks which server in a pool gets the next request. The pool holds its lock around
+// every call, so implementations don't need their own.
+type Balancer interface {
+	Add(s *server_struct)
+	Remove(s *server_struct)
+	// Returns a server that passes usable, or nil if there is none
+	Pick(r *http.Request, usable func(*server_struct) bool) *server_struct
+	// Called after the in_queue or latency of s changed
+	Update(s *server_struct)
+}
+
+const default_balancer = "least_request"
+
+func new_balancer(pc pool_config) (Balancer, error) {
+	switch pc.Balancer {
+	case "", default_balancer:
+		b := &heap_balancer{}
+		heap.Init(&b.sh)
+		return b, nil
+	case "round_robin":
+		return &round_robin_balancer{}, nil
+	case "weighted_round_robin":
+		return &weighted_round_robin_balancer{current: make(map[*server_struct]float64)}, nil
+	case "random":
+		return &random_balancer{}, nil
+	case "p2c":
+		return &p2c_balancer{}, nil
+	case "least_connections":
+		return &least_connections_balancer{}, nil
+	case "least_latency":
+		return &least_latency_balancer{}, nil
+	case "ring_hash":
+		if err := validate_hash_on(pc.HashOn); err != nil {
+			return nil, err
+		}
+		return &ring_hash_balancer{hash_on: pc.HashOn}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", pc.Balancer)
+}
+
+// Plain slice of members, shared by the balancers that don't need anything fancier
+type server_list []*server_struct
+
+func (l *server_list) Add(s *server_struct) { *l = append(*l, s) }
+func (l *server_list) Remove(s *server_struct) {
+	for i, other := range *l {
+		if other == s {
+			*l = append((*l)[:i], (*l)[i+1:]...)
+			return
+		}
+	}
+}
+func (l *server_list) Update(s *server_struct) {}
+
+func (l server_list) usable(usable func(*server_struct) bool) []*server_struct {
+	list := make([]*server_struct, 0, len(l))
+	for _, s := range l {
+		if usable(s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Heap for queue
+type ServerHeap []*server_struct         // Get the server with the lowest load (queue)
+func (sh ServerHeap) Len() int           { return len(sh) }
+func (sh ServerHeap) Less(i, j int) bool { return load(sh[i]) < load(sh[j]) }
+func (sh ServerHeap) Swap(i, j int) {
+	sh[i], sh[j] = sh[j], sh[i]
+	sh[i].index = i
+	sh[j].index = j
+}
+func (sh *ServerHeap) Push(element any) {
+	n := len(*sh)
+	element.(*server_struct).index = n
+	*sh = append(*sh, element.(*server_struct))
+}
+func (sh *ServerHeap) Pop() any {
+	// Internally the first element is swapped with the last one. We need the last element and heapify the first n-1
+	old_heap := *sh
+	n := len(old_heap)
+	x := old_heap[n-1]
+	x.index = -1 // mark as removed
+	*sh = old_heap[0 : n-1]
+	return x
+}
+
+// Least outstanding requests, the original gateway behaviour. Weights divide the queue length so
+// heavier and fully ramped up servers sort first.
+type heap_balancer struct {
+	sh      ServerHeap
+	settled bool // Nobody is in slow start, loads only move on pick and release where heap.Fix runs
+}
+
+func (b *heap_balancer) Add(s *server_struct) {
+	heap.Push(&b.sh, s)
+	b.settled = false
+}
+func (b *heap_balancer) Remove(s *server_struct) {
+	if s.index >= 0 {
+		heap.Remove(&b.sh, s.index)
+	}
+}
+func (b *heap_balancer) Update(s *server_struct) {
+	if s.index >= 0 { // Server might have exited while the request was in flight
+		heap.Fix(&b.sh, s.index)
+	}
+}
+func (b *heap_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	if len(b.sh) == 0 {
+		return nil
+	}
+	if !b.settled {
+		b.reorder(time.Now())
+	}
+	if usable(b.sh[0]) {
+		return b.sh[0]
+	}
+	// Top of the heap is down or already tried, fall back to the least loaded one that is up
+	var best *server_struct
+	for _, s := range b.sh {
+		if usable(s) && (best == nil || load(s) < load(best)) {
+			best = s
+		}
+	}
+	return best
+}
+
+// Weights still ramping up change the loads behind the heap's back, so it gets rebuilt on every
+// pick until the last server is fully ramped up, and once more after that
+func (b *heap_balancer) reorder(now time.Time) {
+	ramping := false
+	for _, s := range b.sh {
+		if s.slow_start > 0 && now.Sub(s.added) < s.slow_start {
+			ramping = true
+			break
+		}
+	}
+	heap.Init(&b.sh)
+	b.settled = !ramping
+}
+
+type round_robin_balancer struct {
+	server_list
+	next int
+}
+
+func (b *round_robin_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	for i := 0; i < len(b.server_list); i++ {
+		s := b.server_list[(b.next+i)%len(b.server_list)]
+		if usable(s) {
+			b.next = (b.next + i + 1) % len(b.server_list)
+			return s
+		}
+	}
+	return nil
+}
+
+// Smooth weighted round robin (the nginx one): spreads heavy servers out instead of bursting them
+type weighted_round_robin_balancer struct {
+	server_list
+	current map[*server_struct]float64
+}
+
+func (b *weighted_round_robin_balancer) Remove(s *server_struct) {
+	b.server_list.Remove(s)
+	delete(b.current, s)
+}
+
+func (b *weighted_round_robin_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	var best *server_struct
+	total := 0.0
+	for _, s := range b.server_list.usable(usable) {
+		w := s.effective_weight()
+		b.current[s] += w
+		total += w
+		if best == nil || b.current[s] > b.current[best] {
+			best = s
+		}
+	}
+	if best != nil {
+		b.current[best] -= total
+	}
+	return best
+}
+
+// Weighted random
+type random_balancer struct {
+	server_list
+}
+
+func (b *random_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	return weighted_random(b.server_list.usable(usable))
+}
+
+func weighted_random(list []*server_struct) *server_struct {
+	total := 0.0
+	for _, s := range list {
+		total += s.effective_weight()
+	}
+	if total <= 0 {
+		return nil
+	}
+	target := rand.Float64() * total
+	for _, s := range list {
+		target -= s.effective_weight()
+		if target < 0 {
+			return s
+		}
+	}
+	return list[len(list)-1]
+}
+
+// Power of two choices: two random servers, the less loaded one wins
+type p2c_balancer struct {
+	server_list
+}
+
+func (b *p2c_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	list := b.server_list.usable(usable)
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	i := rand.IntN(len(list))
+	j := rand.IntN(len(list) - 1)
+	if j >= i {
+		j++ // Two different servers
+	}
+	if load(list[j]) < load(list[i]) {
+		return list[j]
+	}
+	return list[i]
+}
+
+// Outstanding requests (counting the one about to be sent) relative to how much the server is
+// supposed to take. The +1 keeps an idle server that is still in slow start behind idle full ones.
+func load(s *server_struct) float64 {
+	return float64(s.in_queue+1) / s.effective_weight()
+}
+
+// Weighted least connections, a linear scan instead of the heap so weights can count
+type least_connections_balancer struct {
+	server_list
+}
+
+func (b *least_connections_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	var best *server_struct
+	for _, s := range b.server_list.usable(usable) {
+		if best == nil || load(s) < load(best) {
+			best = s
+		}
+	}
+	return best
+}
+
+// Lowest EWMA latency times outstanding requests (peak EWMA), so a fast server doesn't get buried
+type least_latency_balancer struct {
+	server_list
+}
+
+// A new server starts at the pool's average so it neither takes all the traffic nor none of it
+// until its first response. The first real sample replaces the seed.
+func (b *least_latency_balancer) Add(s *server_struct) {
+	total, sampled := 0.0, 0
+	for _, other := range b.server_list {
+		if !other.latency_updated.IsZero() {
+			total += other.latency_ewma
+			sampled++
+		}
+	}
+	if sampled > 0 {
+		s.latency_ewma = total / float64(sampled)
+	}
+	b.server_list.Add(s)
+}
+
+// Floor for servers without any latency yet, so their outstanding requests still count
+const min_latency_ms = 1.0
+
+func (b *least_latency_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	var best *server_struct
+	best_score := 0.0
+	for _, s := range b.server_list.usable(usable) {
+		score := max(s.latency_ewma, min_latency_ms) * float64(s.in_queue+1) / s.effective_weight()
+		if best == nil || score < best_score {
+			best, best_score = s, score
+		}
+	}
+	return best
+}
+
+// How fast old latency samples fade out of the EWMA
+const latency_decay = 10 * time.Second
+
+// A failed attempt counts as at least this slow, and at least twice the server's usual latency
+const failure_latency = time.Second
+
+// Folds one attempt into the server's EWMA. Caller holds the pool lock.
+func (s *server_struct) observe_latency(outcome upstream_outcome, now time.Time) {
+	sample := float64(outcome.rtt) / float64(time.Millisecond)
+	if outcome.failed {
+		sample = max(sample, float64(failure_latency/time.Millisecond), 2*s.latency_ewma)
+	}
+	if s.latency_updated.IsZero() {
+		s.latency_ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.latency_updated)) / float64(latency_decay))
+		s.latency_ewma = s.latency_ewma*w + sample*(1-w)
+	}
+	s.latency_updated = now
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Live servers on ports 1, 2, ... with the given weights, the way pool.add leaves them
+func test_servers(weights ...int) []*server_struct {
+	servers := make([]*server_struct, len(weights))
+	for i, w := range weights {
+		servers[i] = &server_struct{port: string(rune('1' + i)), weight: w, alive: true, index: -1}
+	}
+	return servers
+}
+
+func any_server(*server_struct) bool { return true }
+
+// Picks n times without releasing anything and counts where the requests went, by port
+func pick_counts(t *testing.T, b Balancer, usable func(*server_struct) bool, n int) map[string]int {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	counts := make(map[string]int)
+	for range n {
+		s := b.Pick(r, usable)
+		if s == nil {
+			t.Fatal("no server picked")
+		}
+		s.in_queue++
+		b.Update(s)
+		counts[s.port]++
+	}
+	return counts
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		balancer string
+		weights  []int
+		picks    int
+		want     map[string]int
+	}{
+		{"round_robin", []int{1, 1, 1}, 6, map[string]int{"1": 2, "2": 2, "3": 2}},
+		{"round_robin", []int{1, 5}, 4, map[string]int{"1": 2, "2": 2}}, // Weights don't count
+		{"weighted_round_robin", []int{1, 3}, 8, map[string]int{"1": 2, "2": 6}},
+		{"weighted_round_robin", []int{2, 1, 1}, 8, map[string]int{"1": 4, "2": 2, "3": 2}},
+		{"least_request", []int{1, 1}, 6, map[string]int{"1": 3, "2": 3}},
+		{"least_request", []int{1, 3}, 8, map[string]int{"1": 2, "2": 6}},
+		{"least_connections", []int{1, 3}, 8, map[string]int{"1": 2, "2": 6}},
+		{"least_latency", []int{1, 1}, 4, map[string]int{"1": 2, "2": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.balancer, func(t *testing.T) {
+			b, err := new_balancer(pool_config{Balancer: tt.balancer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range test_servers(tt.weights...) {
+				b.Add(s)
+			}
+			got := pick_counts(t, b, any_server, tt.picks)
+			for port, n := range tt.want {
+				if got[port] != n {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBalancerSkipsUnusable(t *testing.T) {
+	for _, name := range []string{"round_robin", "weighted_round_robin", "random", "p2c", "least_request", "least_connections", "least_latency"} {
+		t.Run(name, func(t *testing.T) {
+			b, _ := new_balancer(pool_config{Balancer: name})
+			servers := test_servers(5, 1, 5)
+			for _, s := range servers {
+				b.Add(s)
+			}
+			only_second := func(s *server_struct) bool { return s == servers[1] }
+			if got := pick_counts(t, b, only_second, 5); got["2"] != 5 {
+				t.Fatalf("got %v, want everything on 2", got)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			if s := b.Pick(r, func(*server_struct) bool { return false }); s != nil {
+				t.Fatalf("picked %s with nothing usable", s.port)
+			}
+		})
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		setup func(servers []*server_struct) // Called between adding the first and the second server
+		after func(servers []*server_struct) // Called once both are in
+		picks int
+		want  map[string]int
+	}{
+		{"no samples yet, outstanding requests decide", nil, nil, 6, map[string]int{"1": 3, "2": 3}},
+		{"new server starts at the pool average", func(servers []*server_struct) {
+			servers[0].observe_latency(upstream_outcome{rtt: 50 * time.Millisecond}, now)
+		}, nil, 4, map[string]int{"1": 2, "2": 2}},
+		{"faster server gets more", func(servers []*server_struct) {
+			servers[0].observe_latency(upstream_outcome{rtt: 100 * time.Millisecond}, now)
+		}, func(servers []*server_struct) {
+			servers[1].observe_latency(upstream_outcome{rtt: 25 * time.Millisecond}, now)
+		}, 5, map[string]int{"1": 1, "2": 4}},
+		{"server that refuses connections stops getting traffic", func(servers []*server_struct) {
+			servers[0].observe_latency(upstream_outcome{rtt: 50 * time.Millisecond}, now)
+		}, func(servers []*server_struct) {
+			// Refused right away, which alone would make it look like the fastest server around
+			servers[1].observe_latency(upstream_outcome{rtt: time.Millisecond, failed: true}, now.Add(latency_decay))
+		}, 10, map[string]int{"1": 10, "2": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &least_latency_balancer{}
+			servers := test_servers(1, 1)
+			b.Add(servers[0])
+			if tt.setup != nil {
+				tt.setup(servers)
+			}
+			b.Add(servers[1])
+			if tt.after != nil {
+				tt.after(servers)
+			}
+			got := pick_counts(t, b, any_server, tt.picks)
+			for port, n := range tt.want {
+				if got[port] != n {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastLatencySeed(t *testing.T) {
+	now := time.Now()
+	b := &least_latency_balancer{}
+	servers := test_servers(1, 1, 1, 1)
+	for i, rtt := range []time.Duration{40 * time.Millisecond, 60 * time.Millisecond, 0} {
+		b.Add(servers[i])
+		if rtt > 0 {
+			servers[i].observe_latency(upstream_outcome{rtt: rtt}, now)
+		}
+	}
+	b.Add(servers[3])
+	if servers[3].latency_ewma != 50 || !servers[3].latency_updated.IsZero() {
+		t.Fatalf("seeded with %v (updated %v), want 50 and no sample", servers[3].latency_ewma, servers[3].latency_updated)
+	}
+	// The first real sample replaces the seed instead of being averaged into it
+	servers[3].observe_latency(upstream_outcome{rtt: 200 * time.Millisecond}, now)
+	if servers[3].latency_ewma != 200 {
+		t.Fatalf("got %v after the first sample, want 200", servers[3].latency_ewma)
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	now := time.Now()
+	faded := math.Exp(-1) // Weight left on the old EWMA after one latency_decay
+	tests := []struct {
+		name    string
+		ewma    float64 // Previous EWMA, sampled one latency_decay ago; 0 for no sample yet
+		outcome upstream_outcome
+		want    float64
+	}{
+		{"first sample", 0, upstream_outcome{rtt: 20 * time.Millisecond}, 20},
+		{"first failure counts as failure_latency", 0, upstream_outcome{rtt: 5 * time.Millisecond, failed: true}, 1000},
+		{"slow failure keeps its own time", 0, upstream_outcome{rtt: 3 * time.Second, failed: true}, 3000},
+		{"sample decays into the EWMA", 100, upstream_outcome{rtt: 20 * time.Millisecond}, 100*faded + 20*(1-faded)},
+		{"failure counts at least twice the usual latency", 800, upstream_outcome{rtt: time.Millisecond, failed: true}, 800*faded + 1600*(1-faded)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server_struct{latency_ewma: tt.ewma}
+			if tt.ewma > 0 {
+				s.latency_updated = now.Add(-latency_decay)
+			}
+			s.observe_latency(tt.outcome, now)
+			if math.Abs(s.latency_ewma-tt.want) > 1e-9 {
+				t.Fatalf("got %v, want %v", s.latency_ewma, tt.want)
+			}
+		})
+	}
+}
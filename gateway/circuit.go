@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Circuit breaker per upstream server. Closed lets everything through, open lets nothing through
+// until OpenTime passes, then half open lets a few probe requests through to decide which way to go.
+// Failed requests return fast, so without this a dying server looks like the least loaded one.
+type circuit_config struct {
+	FailureRatio        float64  `json:"failure_ratio"`        // Share of failed calls in Window that opens the circuit, 0 turns it off
+	ConsecutiveFailures int      `json:"consecutive_failures"` // Failures in a row that open the circuit, 0 turns it off
+	SlowCallDuration    duration `json:"slow_call_duration"`   // Calls slower than this count as slow
+	SlowCallRatio       float64  `json:"slow_call_ratio"`      // Share of slow calls in Window that opens the circuit, 0 turns it off
+	MinRequests         int      `json:"min_requests"`         // Ratios are only judged after this many calls in the window
+	Window              duration `json:"window"`
+	OpenTime            duration `json:"open_time"`          // How long an open circuit rejects before probing
+	HalfOpenRequests    int      `json:"half_open_requests"` // Probes let through while half open, all must succeed to close
+}
+
+func (cc *circuit_config) validate() error {
+	if cc.FailureRatio < 0 || cc.FailureRatio > 1 || cc.SlowCallRatio < 0 || cc.SlowCallRatio > 1 {
+		return errors.New("ratios must be between 0 and 1")
+	}
+	if cc.ConsecutiveFailures < 0 || cc.MinRequests < 0 {
+		return errors.New("thresholds can't be negative")
+	}
+	if cc.SlowCallRatio > 0 && cc.SlowCallDuration <= 0 {
+		return errors.New("slow_call_ratio needs a slow_call_duration")
+	}
+	if cc.Window <= 0 || cc.OpenTime <= 0 || cc.HalfOpenRequests < 1 {
+		return errors.New("window and open_time must be positive and half_open_requests at least 1")
+	}
+	return nil
+}
+
+type circuit_phase int
+
+const (
+	circuit_closed circuit_phase = iota
+	circuit_open
+	circuit_half_open
+)
+
+func (c circuit_phase) String() string {
+	switch c {
+	case circuit_open:
+		return "open"
+	case circuit_half_open:
+		return "half_open"
+	}
+	return "closed"
+}
+
+type circuit_transition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// Transitions kept per server for the admin view
+const circuit_history = 10
+
+// Circuit state of one server, guarded by server_struct.mu
+type circuit_state struct {
+	phase        circuit_phase
+	changed      time.Time // When phase was entered
+	window_start time.Time
+	calls        int
+	failures     int
+	slow         int
+	consecutive  int
+	probes       int // Half open calls let through so far
+	successes    int // Half open calls that worked
+	history      []circuit_transition
+}
+
+// Whether the circuit lets a request through right now. Caller holds s.mu.
+func (s *server_struct) circuit_permits(now time.Time) bool {
+	c := &s.circuit
+	switch c.phase {
+	case circuit_open:
+		return now.Sub(c.changed) >= time.Duration(cfg().CircuitBreaker.OpenTime)
+	case circuit_half_open:
+		return c.probes < cfg().CircuitBreaker.HalfOpenRequests
+	}
+	return true
+}
+
+// Called once the balancer settled on this server, so only picked servers use up probes
+func (s *server_struct) circuit_admit(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.circuit
+	if c.phase == circuit_open {
+		s.trip(circuit_half_open, "open_time elapsed", now)
+	}
+	if c.phase == circuit_half_open {
+		c.probes++
+	}
+}
+
+// Gives back a half open probe slot when the attempt ended without saying anything about the
+// server, say the client's body was too large. Otherwise the circuit would wait forever for a
+// verdict that never comes.
+func release_probe(server *server_struct) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c := &server.circuit
+	if c.phase == circuit_half_open && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// Called once per upstream attempt with whether it worked and how long it took
+func record_circuit(server *server_struct, ok bool, elapsed time.Duration) {
+	cc := cfg().CircuitBreaker
+	now := time.Now()
+	slow := cc.SlowCallDuration > 0 && elapsed > time.Duration(cc.SlowCallDuration)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c := &server.circuit
+	switch c.phase {
+	case circuit_half_open:
+		if !ok || slow {
+			server.trip(circuit_open, "probe failed", now)
+			return
+		}
+		c.successes++
+		if c.successes >= cc.HalfOpenRequests {
+			server.trip(circuit_closed, "probes succeeded", now)
+		}
+		return
+	case circuit_open:
+		return // Stragglers sent before it opened
+	}
+
+	if now.Sub(c.window_start) > time.Duration(cc.Window) {
+		c.window_start = now
+		c.calls, c.failures, c.slow = 0, 0, 0
+	}
+	c.calls++
+	if slow {
+		c.slow++
+	}
+	if ok {
+		c.consecutive = 0
+	} else {
+		c.failures++
+		c.consecutive++
+	}
+
+	judged := c.calls >= cc.MinRequests
+	switch {
+	case cc.ConsecutiveFailures > 0 && c.consecutive >= cc.ConsecutiveFailures:
+		server.trip(circuit_open, "consecutive failures", now)
+	case cc.FailureRatio > 0 && judged && float64(c.failures)/float64(c.calls) >= cc.FailureRatio:
+		server.trip(circuit_open, "failure ratio", now)
+	case cc.SlowCallRatio > 0 && judged && float64(c.slow)/float64(c.calls) >= cc.SlowCallRatio:
+		server.trip(circuit_open, "slow call ratio", now)
+	}
+}
+
+// Moves the circuit to a new phase and starts its counters over. Caller holds s.mu.
+func (s *server_struct) trip(to circuit_phase, reason string, now time.Time) {
+	c := &s.circuit
+	from := c.phase
+	c.phase = to
+	c.changed = now
+	c.window_start = now
+	c.calls, c.failures, c.slow, c.consecutive = 0, 0, 0, 0
+	c.probes, c.successes = 0, 0
+
+	c.history = append(c.history, circuit_transition{From: from.String(), To: to.String(), At: now, Reason: reason})
+	if len(c.history) > circuit_history {
+		c.history = c.history[1:]
+	}
+	circuit_transitions.Add(to.String(), 1)
+	if to == circuit_open {
+		log.Printf("[WARNING] Circuit for server %s in pool %s opened (%s)", s.port, s.pool, reason)
+	} else {
+		log.Printf("Circuit for server %s in pool %s went from %s to %s (%s)", s.port, s.pool, from, to, reason)
+	}
+}
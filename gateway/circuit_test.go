@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Makes cc the circuit breaker settings for the test
+func use_circuit(t *testing.T, cc circuit_config) {
+	t.Helper()
+	conf := default_config()
+	conf.CircuitBreaker = cc
+	use_config(t, conf)
+}
+
+type circuit_call struct {
+	ok      bool
+	elapsed time.Duration
+}
+
+func TestCircuitOpens(t *testing.T) {
+	ok := circuit_call{true, time.Millisecond}
+	failed := circuit_call{false, time.Millisecond}
+	slow := circuit_call{true, time.Second}
+	base := circuit_config{Window: duration(time.Minute), OpenTime: duration(time.Minute), HalfOpenRequests: 1}
+	with := func(change func(*circuit_config)) circuit_config {
+		cc := base
+		change(&cc)
+		return cc
+	}
+	consecutive := with(func(cc *circuit_config) { cc.ConsecutiveFailures = 3 })
+	ratio := with(func(cc *circuit_config) { cc.FailureRatio = 0.5; cc.MinRequests = 4 })
+	slow_ratio := with(func(cc *circuit_config) {
+		cc.SlowCallRatio = 0.5
+		cc.SlowCallDuration = duration(100 * time.Millisecond)
+		cc.MinRequests = 2
+	})
+	tests := []struct {
+		name  string
+		cc    circuit_config
+		calls []circuit_call
+		want  circuit_phase
+	}{
+		{"consecutive failures", consecutive, []circuit_call{failed, failed, failed}, circuit_open},
+		{"a success resets the count", consecutive, []circuit_call{failed, failed, ok, failed, failed}, circuit_closed},
+		{"failure ratio", ratio, []circuit_call{ok, failed, ok, failed}, circuit_open},
+		{"failure ratio waits for min_requests", ratio, []circuit_call{failed, failed, failed}, circuit_closed},
+		{"slow call ratio", slow_ratio, []circuit_call{slow, ok, slow}, circuit_open},
+		{"fast calls", slow_ratio, []circuit_call{ok, ok, slow, ok}, circuit_closed},
+		{"turned off", base, []circuit_call{failed, failed, failed, failed, failed}, circuit_closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			use_circuit(t, tt.cc)
+			s := test_servers(1)[0]
+			for _, call := range tt.calls {
+				record_circuit(s, call.ok, call.elapsed)
+			}
+			if s.circuit.phase != tt.want {
+				t.Fatalf("got %s, want %s", s.circuit.phase, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitHalfOpen(t *testing.T) {
+	open_time := time.Minute
+	tests := []struct {
+		name     string
+		probes   []bool // Outcome of each probe, in order
+		released int    // Probes given back without a verdict before the outcomes come in
+		want     circuit_phase
+	}{
+		{"all probes succeed", []bool{true, true}, 0, circuit_closed},
+		{"a probe fails", []bool{true, false}, 0, circuit_open},
+		{"one probe short", []bool{true}, 0, circuit_half_open},
+		{"released probe can be sent again", []bool{true, true}, 1, circuit_closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			use_circuit(t, circuit_config{ConsecutiveFailures: 1, Window: duration(time.Minute), OpenTime: duration(open_time), HalfOpenRequests: 2})
+			s := test_servers(1)[0]
+			record_circuit(s, false, time.Millisecond)
+			now := time.Now()
+			if s.circuit_permits(now) {
+				t.Fatal("open circuit let a request through")
+			}
+			later := now.Add(open_time)
+			if !s.circuit_permits(later) {
+				t.Fatal("open circuit still rejecting after open_time")
+			}
+			for range 2 {
+				s.circuit_admit(later)
+			}
+			if s.circuit.phase != circuit_half_open || s.circuit_permits(later) {
+				t.Fatalf("got %s with %d probes, want half open with no probes left", s.circuit.phase, s.circuit.probes)
+			}
+			for range tt.released {
+				release_probe(s)
+				if !s.circuit_permits(later) {
+					t.Fatal("released probe not given back")
+				}
+				s.circuit_admit(later)
+			}
+			for _, ok := range tt.probes {
+				record_circuit(s, ok, time.Millisecond)
+			}
+			if s.circuit.phase != tt.want {
+				t.Fatalf("got %s, want %s", s.circuit.phase, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseProbeOutsideHalfOpen(t *testing.T) {
+	use_circuit(t, circuit_config{ConsecutiveFailures: 1, Window: duration(time.Minute), OpenTime: duration(time.Minute), HalfOpenRequests: 1})
+	s := test_servers(1)[0]
+	release_probe(s)
+	if s.circuit.probes != 0 || s.circuit.phase != circuit_closed {
+		t.Fatalf("got %s with %d probes", s.circuit.phase, s.circuit.probes)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Caps on how much a pool takes on at once. Requests over the cap wait in a bounded queue.
+type concurrency_config struct {
+	MaxConcurrent          int              `json:"max_concurrent"`            // Whole pool, 0 is unlimited
+	MaxConcurrentPerServer int              `json:"max_concurrent_per_server"` // 0 is unlimited
+	QueueSize              int              `json:"queue_size"`                // Requests allowed to wait for a slot, 0 rejects right away
+	QueueTimeout           duration         `json:"queue_timeout"`             // How long one may wait before getting a 503
+	Adaptive               *adaptive_config `json:"adaptive"`                  // Moves the pool limit based on observed latency
+}
+
+// aimd: add one slot per limit's worth of fast responses, multiply by backoff on a slow or failed one.
+// gradient: scale the limit by min_rtt / rtt, the way Netflix's concurrency-limits does.
+type adaptive_config struct {
+	Algorithm    string   `json:"algorithm"` // aimd or gradient
+	MinLimit     int      `json:"min_limit"`
+	MaxLimit     int      `json:"max_limit"`
+	InitialLimit int      `json:"initial_limit"`
+	Target       duration `json:"target_latency"` // aimd only: responses slower than this count as congestion
+	Backoff      float64  `json:"backoff"`        // aimd only: multiplier on congestion, e.g. 0.9
+}
+
+var err_no_upstream = errors.New("no upstream servers available")
+var err_queue_full = errors.New("upstream busy and the queue is full")
+var err_queue_timeout = errors.New("timed out waiting for an upstream slot")
+
+func (cc *concurrency_config) validate() error {
+	if cc.MaxConcurrent < 0 || cc.MaxConcurrentPerServer < 0 || cc.QueueSize < 0 || cc.QueueTimeout < 0 {
+		return errors.New("concurrency limits can't be negative")
+	}
+	if cc.QueueSize > 0 && cc.QueueTimeout == 0 {
+		return errors.New("queue_timeout is required with a queue")
+	}
+	a := cc.Adaptive
+	if a == nil {
+		return nil
+	}
+	if a.Algorithm != "aimd" && a.Algorithm != "gradient" {
+		return fmt.Errorf("unknown adaptive algorithm %q", a.Algorithm)
+	}
+	if a.MinLimit < 1 || a.MaxLimit < a.MinLimit || a.InitialLimit < a.MinLimit || a.InitialLimit > a.MaxLimit {
+		return errors.New("adaptive limits need 1 <= min_limit <= initial_limit <= max_limit")
+	}
+	if a.Algorithm == "aimd" && (a.Target <= 0 || a.Backoff <= 0 || a.Backoff >= 1) {
+		return errors.New("aimd needs a positive target_latency and a backoff between 0 and 1")
+	}
+	return nil
+}
+
+// Current adaptive limit and what it learned so far. Guarded by the pool lock.
+type adaptive_limiter struct {
+	settings adaptive_config
+	limit    float64
+	min_rtt  time.Duration // gradient only
+	samples  int           // gradient only: min_rtt is relearned every so often in case the floor moved
+}
+
+const gradient_reset_samples = 1000
+const gradient_smoothing = 0.2
+
+func new_adaptive_limiter(settings adaptive_config) *adaptive_limiter {
+	return &adaptive_limiter{settings: settings, limit: float64(settings.InitialLimit)}
+}
+
+// A failed attempt counts as congestion. One that says nothing about the server, because the
+// client went away or it never got sent, leaves the limit alone.
+func (a *adaptive_limiter) observe(outcome upstream_outcome) {
+	if outcome == (upstream_outcome{}) {
+		return
+	}
+	s := a.settings
+	rtt := outcome.rtt
+	switch s.Algorithm {
+	case "aimd":
+		if outcome.failed || rtt > time.Duration(s.Target) {
+			a.limit *= s.Backoff
+		} else {
+			a.limit += 1 / a.limit
+		}
+	case "gradient":
+		if outcome.failed {
+			a.limit *= 0.9
+			break
+		}
+		a.samples++
+		if a.min_rtt == 0 || rtt < a.min_rtt || a.samples >= gradient_reset_samples {
+			a.min_rtt = rtt
+			a.samples = 0
+		}
+		gradient := math.Max(0.5, math.Min(1, float64(a.min_rtt)/float64(rtt)))
+		next := a.limit*gradient + math.Sqrt(a.limit) // sqrt leaves some headroom to probe upwards
+		a.limit = a.limit*(1-gradient_smoothing) + next*gradient_smoothing
+	}
+	a.limit = math.Max(float64(s.MinLimit), math.Min(float64(s.MaxLimit), a.limit))
+}
+
+// Applies new limits on reload. The adaptive state survives unless its settings changed.
+// Caller holds p.mu unless the pool is brand new.
+func (p *upstream_pool) configure_limits(cc concurrency_config) {
+	p.limits = cc
+	if cc.Adaptive == nil {
+		p.adaptive = nil
+	} else if p.adaptive == nil || p.adaptive.settings != *cc.Adaptive {
+		p.adaptive = new_adaptive_limiter(*cc.Adaptive)
+	}
+	p.wake_waiters() // A higher limit may have freed slots
+}
+
+// Pool wide limit right now, 0 when there is none
+func (p *upstream_pool) pool_limit() int {
+	limit := p.limits.MaxConcurrent
+	if p.adaptive != nil {
+		adaptive := int(p.adaptive.limit)
+		if limit == 0 || adaptive < limit {
+			limit = adaptive
+		}
+	}
+	return limit
+}
+
+func (p *upstream_pool) under_server_limit(s *server_struct) bool {
+	return p.limits.MaxConcurrentPerServer == 0 || s.in_queue < p.limits.MaxConcurrentPerServer
+}
+
+// Like pick, but waits in the pool's queue when every usable server is at its limit. A waiter
+// that was woken up but lost the slot to a newcomer goes back to the front of the line.
+func (p *upstream_pool) acquire(ctx context.Context, r *http.Request) (*server_struct, error) {
+	var deadline <-chan time.Time
+	woken := false
+	for {
+		p.mu.Lock()
+		server, full := p.try_pick(r, nil)
+		if server != nil {
+			p.mu.Unlock()
+			return server, nil
+		}
+		if !full {
+			p.mu.Unlock()
+			return nil, err_no_upstream
+		}
+		if !woken && p.queue.Len() >= p.limits.QueueSize {
+			p.mu.Unlock()
+			return nil, err_queue_full
+		}
+		if deadline == nil {
+			timer := time.NewTimer(time.Duration(p.limits.QueueTimeout))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		wake := make(chan struct{})
+		var element *list.Element
+		if woken {
+			element = p.queue.PushFront(wake)
+		} else {
+			element = p.queue.PushBack(wake)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-wake:
+			woken = true
+			continue // A slot opened up, try again
+		case <-deadline:
+			p.leave_queue(element, wake)
+			return nil, err_queue_timeout
+		case <-ctx.Done():
+			p.leave_queue(element, wake)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Gives up a place in the queue. A wake up that raced with giving up goes to the next in line.
+func (p *upstream_pool) leave_queue(element *list.Element, wake chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-wake:
+		p.wake_waiters()
+	default:
+		p.queue.Remove(element)
+	}
+}
+
+// Lets the next waiter in line try again. Caller holds p.mu.
+func (p *upstream_pool) wake_waiters() {
+	if p.queue == nil {
+		return
+	}
+	if front := p.queue.Front(); front != nil {
+		p.queue.Remove(front)
+		close(front.Value.(chan struct{}))
+	}
+}
+
+// Gateway wide cap on requests being proxied, 0 is unlimited
+var gateway_inflight atomic.Int64
+
+func enter_gateway(limit int) bool {
+	if limit <= 0 {
+		gateway_inflight.Add(1)
+		return true
+	}
+	if gateway_inflight.Add(1) > int64(limit) {
+		gateway_inflight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func leave_gateway() {
+	gateway_inflight.Add(-1)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	aimd := adaptive_config{Algorithm: "aimd", MinLimit: 2, MaxLimit: 10, InitialLimit: 4, Target: duration(100 * time.Millisecond), Backoff: 0.5}
+	gradient := adaptive_config{Algorithm: "gradient", MinLimit: 1, MaxLimit: 100, InitialLimit: 16}
+	fast := upstream_outcome{rtt: 10 * time.Millisecond}
+	slow := upstream_outcome{rtt: 40 * time.Millisecond}
+	failed := upstream_outcome{rtt: time.Millisecond, failed: true}
+	after_fast := 16*(1-gradient_smoothing) + (16+4)*gradient_smoothing // min_rtt is the first sample, gradient 1
+	tests := []struct {
+		name     string
+		settings adaptive_config
+		initial  float64 // 0 keeps initial_limit
+		outcomes []upstream_outcome
+		want     float64
+	}{
+		{"aimd adds a slot per limit's worth of fast responses", aimd, 0, []upstream_outcome{fast}, 4.25},
+		{"aimd backs off on a slow response", aimd, 0, []upstream_outcome{{rtt: time.Second}}, 2},
+		{"aimd backs off on a failure", aimd, 0, []upstream_outcome{failed}, 2},
+		{"aimd ignores attempts without a verdict", aimd, 0, []upstream_outcome{{}, {}, {}}, 4},
+		{"aimd stays above min_limit", aimd, 0, []upstream_outcome{failed, failed, failed}, 2},
+		{"aimd stays below max_limit", aimd, 10, []upstream_outcome{fast}, 10},
+		{"gradient grows while latency holds", gradient, 0, []upstream_outcome{fast}, after_fast},
+		{"gradient shrinks when latency rises", gradient, 0, []upstream_outcome{fast, slow},
+			after_fast*(1-gradient_smoothing) + (after_fast*0.5+math.Sqrt(after_fast))*gradient_smoothing},
+		{"gradient backs off on a failure", gradient, 0, []upstream_outcome{failed}, 16 * 0.9},
+		{"gradient ignores attempts without a verdict", gradient, 0, []upstream_outcome{{}, {}}, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := new_adaptive_limiter(tt.settings)
+			if tt.initial > 0 {
+				a.limit = tt.initial
+			}
+			for _, outcome := range tt.outcomes {
+				a.observe(outcome)
+			}
+			if math.Abs(a.limit-tt.want) > 1e-9 {
+				t.Fatalf("got limit %v, want %v", a.limit, tt.want)
+			}
+		})
+	}
+}
+
+// A pool with one live server and the given limits
+func limited_pool(cc concurrency_config) *upstream_pool {
+	p := &upstream_pool{name: "test", servers: make(map[string]*server_struct), queue: list.New()}
+	p.configure(pool_config{Concurrency: cc})
+	p.add(test_servers(1)[0])
+	return p
+}
+
+type acquired struct {
+	server *server_struct
+	err    error
+}
+
+// Runs acquire in the background and waits until it either returned or queued up
+func acquire_async(t *testing.T, ctx context.Context, p *upstream_pool) <-chan acquired {
+	t.Helper()
+	p.mu.Lock()
+	queued := p.queue.Len()
+	p.mu.Unlock()
+	done := make(chan acquired, 1)
+	go func() {
+		s, err := p.acquire(ctx, httptest.NewRequest("GET", "/", nil))
+		done <- acquired{s, err}
+	}()
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(time.Millisecond) {
+		p.mu.Lock()
+		n := p.queue.Len()
+		p.mu.Unlock()
+		if n > queued || len(done) > 0 {
+			return done
+		}
+	}
+	t.Fatal("acquire neither returned nor queued")
+	return nil
+}
+
+func received(done <-chan acquired) (acquired, bool) {
+	select {
+	case a := <-done:
+		return a, true
+	case <-time.After(2 * time.Second):
+		return acquired{}, false
+	}
+}
+
+func TestAcquireQueue(t *testing.T) {
+	limits := concurrency_config{MaxConcurrent: 1, QueueSize: 2, QueueTimeout: duration(time.Minute)}
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(t *testing.T, p *upstream_pool, first *server_struct)
+	}{
+		{"release hands the slot to the waiter", func(t *testing.T, p *upstream_pool, first *server_struct) {
+			waiter := acquire_async(t, ctx, p)
+			p.release(first, upstream_outcome{rtt: time.Millisecond})
+			if a, ok := received(waiter); !ok || a.err != nil || a.server != first {
+				t.Fatalf("got %+v, %v", a, ok)
+			}
+		}},
+		{"queue full", func(t *testing.T, p *upstream_pool, first *server_struct) {
+			acquire_async(t, ctx, p)
+			acquire_async(t, ctx, p)
+			if _, err := p.acquire(ctx, httptest.NewRequest("GET", "/", nil)); !errors.Is(err, err_queue_full) {
+				t.Fatalf("got error %v, want err_queue_full", err)
+			}
+		}},
+		{"queue timeout", func(t *testing.T, p *upstream_pool, first *server_struct) {
+			p.limits.QueueTimeout = duration(10 * time.Millisecond)
+			if a, ok := received(acquire_async(t, ctx, p)); !ok || !errors.Is(a.err, err_queue_timeout) {
+				t.Fatalf("got %+v, want err_queue_timeout", a)
+			}
+			if p.queue.Len() != 0 {
+				t.Fatal("timed out waiter still queued")
+			}
+		}},
+		{"client gives up", func(t *testing.T, p *upstream_pool, first *server_struct) {
+			gone, cancel := context.WithCancel(ctx)
+			waiter := acquire_async(t, gone, p)
+			cancel()
+			if a, ok := received(waiter); !ok || !errors.Is(a.err, context.Canceled) {
+				t.Fatalf("got %+v, want context.Canceled", a)
+			}
+		}},
+		{"woken waiter that loses the slot keeps its place", func(t *testing.T, p *upstream_pool, first *server_struct) {
+			early := acquire_async(t, ctx, p)
+			late := acquire_async(t, ctx, p)
+			// A release whose slot a newcomer grabs before the woken waiter gets to run
+			p.mu.Lock()
+			first.in_queue--
+			p.inflight--
+			p.wake_waiters()
+			newcomer, _ := p.try_pick(httptest.NewRequest("GET", "/", nil), nil)
+			p.mu.Unlock()
+			// The woken waiter finds nothing free and queues again
+			for start := time.Now(); ; time.Sleep(time.Millisecond) {
+				p.mu.Lock()
+				n := p.queue.Len()
+				p.mu.Unlock()
+				if n == 2 {
+					break
+				}
+				if time.Since(start) > 2*time.Second {
+					t.Fatal("woken waiter didn't queue again")
+				}
+			}
+			p.release(newcomer, upstream_outcome{rtt: time.Millisecond})
+			if a, ok := received(early); !ok || a.err != nil {
+				t.Fatalf("the earlier waiter didn't get the slot: %+v", a)
+			}
+			if len(late) > 0 {
+				t.Fatal("the later waiter got a slot too")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := limited_pool(limits)
+			first, err := p.acquire(ctx, httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.run(t, p, first)
+		})
+	}
+}
+
+func TestReleaseWithoutVerdictKeepsTheLimit(t *testing.T) {
+	p := limited_pool(concurrency_config{Adaptive: &adaptive_config{Algorithm: "aimd", MinLimit: 1, MaxLimit: 10, InitialLimit: 5, Target: duration(time.Second), Backoff: 0.5}})
+	for range 3 {
+		s := p.pick(httptest.NewRequest("GET", "/", nil), nil)
+		p.release(s, upstream_outcome{}) // The client hung up
+	}
+	if p.adaptive.limit != 5 {
+		t.Fatalf("got limit %v, want it untouched", p.adaptive.limit)
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// time.Duration that reads "500ms" / "5s" style strings from the config file
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations must be strings like \"500ms\": %w", err)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type listener_config struct {
+	Addr         string              `json:"addr"`
+	TLS          tls_listener_config `json:"tls"`
+	DisableHTTP2 bool                `json:"disable_http2"` // HTTPS listeners offer h2 unless this is set
+	H2C          bool                `json:"h2c"`           // Also accept HTTP/2 without TLS
+	RedirectTo   string              `json:"redirect_to"`   // Only redirect to HTTPS on this port, e.g. ":443"
+}
+
+// Servers listed here are added to the pool at load time, on top of anything that registers itself
+type pool_config struct {
+	Servers  []string `json:"servers"`
+	Balancer string   `json:"balancer"` // least_request (default), round_robin, weighted_round_robin, random, p2c, least_connections, least_latency, ring_hash
+	HashOn   string   `json:"hash_on"`  // ring_hash only: client_ip, header:<name>, cookie:<name> or path_segment:<n>
+
+	Sticky    *sticky_config `json:"sticky"`
+	SlowStart duration       `json:"slow_start"` // New servers ramp up to their full weight over this long
+
+	Concurrency concurrency_config `json:"concurrency"`
+}
+
+// Active health checks against every server's /health
+type heartbeat_config struct {
+	Interval           duration `json:"interval"`
+	Timeout            duration `json:"timeout"`
+	Path               string   `json:"path"`
+	HealthyThreshold   int      `json:"healthy_threshold"`   // Passes in a row before a dead server comes back
+	UnhealthyThreshold int      `json:"unhealthy_threshold"` // Failures in a row before a server is taken out
+}
+
+type telemetry_config struct {
+	Endpoint string `json:"endpoint"` // OTLP/HTTP collector
+}
+
+type gateway_config struct {
+	Listeners  []listener_config             `json:"listeners"`
+	Routes     []route                       `json:"routes"`
+	Pools      map[string]pool_config        `json:"pools"`
+	RateLimits map[string]*rate_limit_policy `json:"rate_limits"`
+	Heartbeat  heartbeat_config              `json:"heartbeat"`
+	Telemetry  telemetry_config              `json:"telemetry"`
+
+	OutlierDetection outlier_config    `json:"outlier_detection"`
+	CircuitBreaker   circuit_config    `json:"circuit_breaker"`
+	RateLimitStore   rate_store_config `json:"rate_limit_store"`
+
+	Timeouts timeout_policy  `json:"timeouts"`
+	Server   server_timeouts `json:"server"`
+
+	// Load balancers in front of us whose X-Forwarded-* headers we believe, CIDRs or single IPs
+	TrustedProxies []string `json:"trusted_proxies"`
+	trusted        []netip.Prefix
+
+	UpstreamTLS      upstream_tls_config `json:"upstream_tls"`
+	upstream_tls     *tls.Config
+	upstream_tls_err error
+	Control          control_config `json:"control"`
+
+	Authenticators     map[string]authenticator_config `json:"authenticators"`
+	authenticators     map[string]authenticator
+	authenticator_errs []error
+	// Policy checked per client before authentication on routes that need it, so guessing
+	// credentials is limited too. Can't be keyed on the consumer, empty turns it off.
+	AuthRateLimit string `json:"auth_rate_limit"`
+
+	AutoBan ban_config `json:"auto_ban"`
+
+	Plans     map[string]plan_config `json:"plans"`
+	Consumers consumers_config       `json:"consumers"`
+
+	MaxBodySize           int64 `json:"max_body_size"`           // Request bodies in bytes, 0 is unlimited
+	MaxConcurrentRequests int   `json:"max_concurrent_requests"` // Across the whole gateway, 0 is unlimited
+}
+
+const default_rate_limit = "default"
+
+// What the gateway ran with before there was a config file
+func default_config() *gateway_config {
+	return &gateway_config{
+		Listeners: []listener_config{{Addr: ":8080"}},
+		Routes: []route{
+			{Prefix: "/echo", Pool: "echo"},
+			{Prefix: "/", Pool: default_pool},
+		},
+		Pools: map[string]pool_config{},
+		RateLimits: map[string]*rate_limit_policy{
+			default_rate_limit: {Algorithm: sliding_window, Window: duration(500 * time.Millisecond), MaxRequests: 35, Key: []string{"ip"}},
+		},
+		AuthRateLimit: default_rate_limit,
+		Heartbeat: heartbeat_config{
+			Interval:           duration(5 * time.Second),
+			Timeout:            duration(2 * time.Second),
+			Path:               "/health",
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+		Telemetry: telemetry_config{Endpoint: "localhost:4318"},
+		Timeouts: timeout_policy{
+			Connect:   duration(2 * time.Second),
+			FirstByte: duration(15 * time.Second),
+			Total:     duration(30 * time.Second),
+		},
+		MaxBodySize: 10 << 20,
+		Control: control_config{
+			Listener:             &listener_config{Addr: "127.0.0.1:9090"}, // Where the app servers register by default
+			AllowUnauthenticated: true,
+			MaxClockSkew:         duration(5 * time.Minute),
+		},
+		Consumers:   consumers_config{FlushInterval: duration(10 * time.Second)},
+		Server: server_timeouts{
+			ReadHeader: duration(5 * time.Second),
+			Read:       duration(30 * time.Second),
+			Write:      duration(60 * time.Second),
+			Idle:       duration(2 * time.Minute),
+		},
+		OutlierDetection: outlier_config{
+			ConsecutiveErrors:  5,
+			ErrorRate:          0.5,
+			MinRequests:        20,
+			Window:             duration(10 * time.Second),
+			BaseEjectionTime:   duration(30 * time.Second),
+			MaxEjectionTime:    duration(5 * time.Minute),
+			MaxEjectionPercent: 50,
+		},
+		CircuitBreaker: circuit_config{
+			FailureRatio:        0.5,
+			ConsecutiveFailures: 5,
+			SlowCallDuration:    duration(2 * time.Second),
+			SlowCallRatio:       0.8,
+			MinRequests:         10,
+			Window:              duration(10 * time.Second),
+			OpenTime:            duration(15 * time.Second),
+			HalfOpenRequests:    3,
+		},
+		RateLimitStore: rate_store_config{
+			Type:        "memory",
+			Timeout:     duration(100 * time.Millisecond),
+			PoolSize:    16,
+			FailureMode: "open",
+			MaxKeys:     100000,
+			IdleTTL:     duration(10 * time.Minute),
+		},
+	}
+}
+
+func (c *gateway_config) validate() error {
+	var errs []error
+	if len(c.Listeners) == 0 {
+		errs = append(errs, errors.New("at least one listener is required"))
+	}
+	for i, l := range c.Listeners {
+		if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("listeners[%d]: %w", i, err))
+		}
+	}
+	for name, policy := range c.RateLimits {
+		if policy == nil {
+			errs = append(errs, fmt.Errorf("rate_limits.%s: empty policy", name))
+		} else if err := policy.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limits.%s: %w", name, err))
+		}
+	}
+	for i, rt := range c.Routes {
+		if rt.Pool == "" {
+			errs = append(errs, fmt.Errorf("routes[%d]: pool is required", i))
+		}
+		if rt.Prefix != "" && !strings.HasPrefix(rt.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("routes[%d]: prefix %q must start with /", i, rt.Prefix))
+		}
+		if rt.RateLimit != "" && c.RateLimits[rt.RateLimit] == nil {
+			errs = append(errs, fmt.Errorf("routes[%d]: unknown rate_limit %q", i, rt.RateLimit))
+		}
+		if rt.Retry != nil && rt.Retry.MaxAttempts < 1 {
+			errs = append(errs, fmt.Errorf("routes[%d]: retry.max_attempts must be at least 1", i))
+		}
+		if rt.Timeouts != nil {
+			if err := rt.Timeouts.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("routes[%d].timeouts: %w", i, err))
+			}
+		}
+		for _, name := range rt.Auth {
+			if _, ok := c.Authenticators[name]; !ok {
+				errs = append(errs, fmt.Errorf("routes[%d]: unknown authenticator %q", i, name))
+			}
+		}
+		if _, err := parse_cidrs(rt.AllowIPs); err != nil {
+			errs = append(errs, fmt.Errorf("routes[%d].allow_ips: %w", i, err))
+		}
+		if _, err := parse_cidrs(rt.DenyIPs); err != nil {
+			errs = append(errs, fmt.Errorf("routes[%d].deny_ips: %w", i, err))
+		}
+		if len(rt.Auth) == 0 && (len(rt.Scopes) > 0 || len(rt.Claims) > 0) {
+			errs = append(errs, fmt.Errorf("routes[%d]: scopes and claims need auth", i))
+		}
+		if rt.MaxBodySize < 0 {
+			errs = append(errs, fmt.Errorf("routes[%d]: max_body_size can't be negative", i))
+		}
+	}
+	port_pool := make(map[string]string) // A port is one server, so it can only be in one pool
+	for name, pc := range c.Pools {
+		if _, err := new_balancer(pc); err != nil {
+			errs = append(errs, fmt.Errorf("pools.%s: %w", name, err))
+		}
+		if pc.SlowStart < 0 {
+			errs = append(errs, fmt.Errorf("pools.%s: slow_start can't be negative", name))
+		}
+		if err := pc.Concurrency.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("pools.%s.concurrency: %w", name, err))
+		}
+		for _, raw := range pc.Servers {
+			_, port, err := parse_server_url(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("pools.%s: %w", name, err))
+				continue
+			}
+			if other, taken := port_pool[port]; taken {
+				errs = append(errs, fmt.Errorf("pools.%s and pools.%s both list port %s", min(name, other), max(name, other), port))
+				continue
+			}
+			port_pool[port] = name
+		}
+	}
+	if c.Heartbeat.Interval <= 0 || c.Heartbeat.Timeout <= 0 {
+		errs = append(errs, errors.New("heartbeat.interval and heartbeat.timeout must be positive"))
+	}
+	if c.Heartbeat.HealthyThreshold < 1 || c.Heartbeat.UnhealthyThreshold < 1 {
+		errs = append(errs, errors.New("heartbeat thresholds must be at least 1"))
+	}
+	if !strings.HasPrefix(c.Heartbeat.Path, "/") {
+		errs = append(errs, fmt.Errorf("heartbeat.path %q must start with /", c.Heartbeat.Path))
+	}
+	od := c.OutlierDetection
+	if od.ConsecutiveErrors < 0 || od.ErrorRate < 0 || od.ErrorRate > 1 || od.MinRequests < 0 {
+		errs = append(errs, errors.New("outlier_detection: thresholds must be >= 0 and error_rate at most 1"))
+	}
+	if od.Window <= 0 || od.BaseEjectionTime <= 0 || od.MaxEjectionTime < od.BaseEjectionTime {
+		errs = append(errs, errors.New("outlier_detection: window and ejection times must be positive, max_ejection_time >= base_ejection_time"))
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		errs = append(errs, errors.New("outlier_detection.max_ejection_percent must be between 0 and 100"))
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("timeouts: %w", err))
+	}
+	if c.Server.ReadHeader < 0 || c.Server.Read < 0 || c.Server.Write < 0 || c.Server.Idle < 0 {
+		errs = append(errs, errors.New("server timeouts can't be negative"))
+	}
+	if err := c.CircuitBreaker.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("circuit_breaker: %w", err))
+	}
+	if _, err := parse_cidrs(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	errs = append(errs, c.authenticator_errs...)
+	if c.upstream_tls_err != nil {
+		errs = append(errs, fmt.Errorf("upstream_tls: %w", c.upstream_tls_err))
+	}
+	if err := c.Control.validate(c.Listeners); err != nil {
+		errs = append(errs, fmt.Errorf("control: %w", err))
+	}
+	if policy := c.RateLimits[c.AuthRateLimit]; c.AuthRateLimit != "" && policy == nil {
+		errs = append(errs, fmt.Errorf("unknown auth_rate_limit %q", c.AuthRateLimit))
+	} else if policy != nil && slices.ContainsFunc(policy.Key, func(part string) bool { return part == "consumer" || part == "api_key" }) {
+		errs = append(errs, fmt.Errorf("auth_rate_limit %q runs before authentication, it can't be keyed on consumer or api_key", c.AuthRateLimit))
+	}
+	if err := c.AutoBan.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("auto_ban: %w", err))
+	}
+	if err := c.validate_plans(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MaxBodySize < 0 {
+		errs = append(errs, errors.New("max_body_size can't be negative"))
+	}
+	if c.MaxConcurrentRequests < 0 {
+		errs = append(errs, errors.New("max_concurrent_requests can't be negative"))
+	}
+	if err := c.RateLimitStore.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit_store: %w", err))
+	}
+	for name, policy := range c.RateLimits {
+		// Evicting a key mid window would hand the client a fresh quota
+		if policy != nil && c.RateLimitStore.Type != "redis" && c.RateLimitStore.IdleTTL < 2*policy.Window {
+			errs = append(errs, fmt.Errorf("rate_limit_store.idle_ttl must be at least twice rate_limits.%s.window", name))
+		}
+	}
+	if c.Telemetry.Endpoint == "" {
+		errs = append(errs, errors.New("telemetry.endpoint is required"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *gateway_config) fill_names() {
+	for name, policy := range c.RateLimits {
+		if policy != nil {
+			policy.name = name
+		}
+	}
+}
+
+// Rate limit policy for a route, falling back to the default one. nil means unlimited.
+func (c *gateway_config) rate_limit_for(rt *route) *rate_limit_policy {
+	name := rt.RateLimit
+	if name == "" {
+		name = default_rate_limit
+	}
+	return c.RateLimits[name]
+}
+
+// Splits "http://host:port" into the URL we forward to and the port that keys the server
+func parse_server_url(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", "", fmt.Errorf("bad server url %q", raw)
+	}
+	port := u.Port()
+	if port == "" {
+		return "", "", fmt.Errorf("server url %q needs an explicit port", raw)
+	}
+	return strings.TrimSuffix(raw, "/"), port, nil
+}
+
+var config_path = flag.String("config", "gateway.json", "path to the gateway config file")
+
+var current_config atomic.Pointer[gateway_config]
+var config_mutex sync.Mutex // Only one reload at a time
+
+// The config in effect right now. Requests grab it once so a reload never changes things under them.
+func cfg() *gateway_config {
+	return current_config.Load()
+}
+
+// Reads the file on top of the defaults. A missing file just means defaults.
+func read_config(path string) (*gateway_config, error) {
+	c := default_config()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No config file at %s, using defaults", path)
+		c.fill_names()
+		c.fill_trusted_proxies()
+		c.fill_upstream_tls()
+		c.fill_authenticators()
+		c.fill_ip_rules()
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields() // Typos should fail loudly rather than be ignored
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	c.fill_names()
+	c.fill_trusted_proxies()
+	c.fill_upstream_tls()
+	c.fill_authenticators()
+	c.fill_ip_rules()
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Swaps in a new config. On any error the old config stays in effect.
+func load_config() error {
+	config_mutex.Lock()
+	defer config_mutex.Unlock()
+	next, err := read_config(*config_path)
+	if err != nil {
+		return err
+	}
+	previous := current_config.Load()
+	if previous != nil {
+		next.keep_authenticators(previous)
+		if fmt.Sprint(previous.Listeners) != fmt.Sprint(next.Listeners) || fmt.Sprint(previous.Control.Listener) != fmt.Sprint(next.Control.Listener) {
+			log.Println("[WARNING] Listener changes only take effect after a restart")
+		}
+		if previous.Server != next.Server {
+			log.Println("[WARNING] Server timeout changes only take effect after a restart")
+		}
+		if previous.Telemetry != next.Telemetry {
+			log.Println("[WARNING] Telemetry changes only take effect after a restart")
+		}
+	}
+	current_config.Store(next)
+	apply_pool_config(previous, next)
+	apply_rate_store_config(next.RateLimitStore)
+	apply_consumers_config(next.Consumers)
+	return nil
+}
+
+// Adds servers listed in the config and drops the ones a previous config listed but this one doesn't
+func apply_pool_config(previous, next *gateway_config) {
+	wanted := make(map[string]bool)
+	for name, pc := range next.Pools {
+		pool := get_pool(name)
+		pool.mu.Lock()
+		pool.configure(pc)
+		pool.mu.Unlock()
+		for _, raw := range pc.Servers {
+			url, port, _ := parse_server_url(raw) // Already validated
+			wanted[name+"|"+port] = true
+			if add_static_server(pool, url, port) {
+				log.Printf("Added configured server %s to pool %s", url, name)
+			}
+		}
+	}
+	// Pools the config no longer mentions go back to the default settings
+	for _, p := range all_pools() {
+		if _, listed := next.Pools[p.name]; !listed {
+			p.mu.Lock()
+			p.configure(pool_config{})
+			p.mu.Unlock()
+		}
+	}
+	if previous == nil {
+		return
+	}
+	for _, p := range all_pools() {
+		for _, server := range p.members() {
+			if server.static && !wanted[p.name+"|"+server.port] {
+				remove_server(server)
+			}
+		}
+	}
+}
+
+// Adds a server from the config file, replacing the one on its port if that moved to another
+// pool or URL. Registered servers keep their port, config or not. False when nothing changed.
+func add_static_server(pool *upstream_pool, url, port string) bool {
+	registry_mutex.Lock()
+	defer registry_mutex.Unlock()
+	if existing := find_server(port); existing != nil {
+		if !existing.static || (existing.pool == pool.name && existing.URL == url) {
+			return false
+		}
+		remove_server(existing)
+	}
+	return pool.add(&server_struct{
+		URL:          url,
+		port:         port,
+		alive:        true,
+		static:       true,
+		last_updated: time.Now().Unix(),
+	})
+}
+
+// Reloads on SIGHUP and whenever the file's modification time changes
+func watch_config() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	last_modified := config_mod_time()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+		case <-ticker.C:
+			modified := config_mod_time()
+			if modified.Equal(last_modified) {
+				continue
+			}
+			last_modified = modified
+			log.Println("Config file changed, reloading")
+		}
+		if err := load_config(); err != nil {
+			log.Printf("[ERROR] Config reload rejected, keeping the old config: %v", err)
+			continue
+		}
+		log.Println("Config reloaded")
+	}
+}
+
+func config_mod_time() time.Time {
+	info, err := os.Stat(*config_path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Runs the test against an empty pool registry and puts the real one back afterwards
+func empty_pools(t *testing.T) {
+	t.Helper()
+	pools_mutex.Lock()
+	previous := pools
+	pools = make(map[string]*upstream_pool)
+	pools_mutex.Unlock()
+	t.Cleanup(func() {
+		pools_mutex.Lock()
+		pools = previous
+		pools_mutex.Unlock()
+	})
+}
+
+func config_with_pools(servers map[string][]string) *gateway_config {
+	c := default_config()
+	for name, list := range servers {
+		c.Pools[name] = pool_config{Servers: list}
+	}
+	return c
+}
+
+func TestValidateDuplicatePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers map[string][]string
+		want    string // Part of the error, empty when the config is fine
+	}{
+		{"different ports", map[string][]string{"a": {"http://localhost:9301"}, "b": {"http://localhost:9302"}}, ""},
+		{"same port in two pools", map[string][]string{"a": {"http://localhost:9301"}, "b": {"http://otherhost:9301"}}, "pools.a and pools.b both list port 9301"},
+		{"same port twice in one pool", map[string][]string{"a": {"http://localhost:9301", "http://localhost:9301/"}}, "pools.a and pools.a both list port 9301"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := config_with_pools(tt.servers).validate()
+			if tt.want == "" && err != nil {
+				t.Fatalf("validate failed: %v", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPoolConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		before map[string][]string
+		after  map[string][]string
+		want   map[string]string // Port to pool|url once the reload is applied
+	}{
+		{"unchanged",
+			map[string][]string{"a": {"http://localhost:9301"}},
+			map[string][]string{"a": {"http://localhost:9301"}},
+			map[string]string{"9301": "a|http://localhost:9301"}},
+		{"moved to another pool",
+			map[string][]string{"a": {"http://localhost:9301"}},
+			map[string][]string{"b": {"http://localhost:9301"}},
+			map[string]string{"9301": "b|http://localhost:9301"}},
+		{"new url on the same port",
+			map[string][]string{"a": {"http://localhost:9301"}},
+			map[string][]string{"a": {"http://10.0.0.5:9301"}},
+			map[string]string{"9301": "a|http://10.0.0.5:9301"}},
+		{"dropped",
+			map[string][]string{"a": {"http://localhost:9301", "http://localhost:9302"}},
+			map[string][]string{"a": {"http://localhost:9302"}},
+			map[string]string{"9301": "", "9302": "a|http://localhost:9302"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			empty_pools(t)
+			first := config_with_pools(tt.before)
+			apply_pool_config(nil, first)
+			apply_pool_config(first, config_with_pools(tt.after))
+			for port, want := range tt.want {
+				got := ""
+				if s := find_server(port); s != nil {
+					got = s.pool + "|" + s.URL
+				}
+				if got != want {
+					t.Fatalf("port %s: got %q, want %q", port, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPoolConfigKeepsRegisteredServers(t *testing.T) {
+	empty_pools(t)
+	get_pool("a").add(&server_struct{URL: "http://localhost:9301", port: "9301", alive: true})
+	apply_pool_config(nil, config_with_pools(map[string][]string{"b": {"http://localhost:9301"}}))
+	if s := find_server("9301"); s == nil || s.pool != "a" || s.static {
+		t.Fatalf("registered server replaced: %+v", s)
+	}
+}
+
+func TestAddUniqueAcrossPools(t *testing.T) {
+	empty_pools(t)
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for _, name := range []string{"a", "b", "c", "d"} {
+		pool := get_pool(name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if add_unique(pool, &server_struct{URL: "http://localhost:9301", port: "9301", alive: true}) {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != 1 {
+		t.Fatalf("%d registrations of one port succeeded, want 1", added.Load())
+	}
+}
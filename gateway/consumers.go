@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Long period quotas. Days and months are UTC calendar ones.
+type plan_config struct {
+	Daily   int64 `json:"daily"`   // Requests per day, 0 is unlimited
+	Monthly int64 `json:"monthly"` // Requests per month, 0 is unlimited
+}
+
+type consumers_config struct {
+	File          string   `json:"file"`           // Managed consumers and usage counters, empty keeps them in memory only
+	FlushInterval duration `json:"flush_interval"` // How often usage is written out, default 10s
+	DefaultPlan   string   `json:"default_plan"`   // Plan for consumers that have none, e.g. ones from a jwt authenticator. Empty means no quota.
+}
+
+// A consumer created through /admin/consumers
+type managed_consumer struct {
+	ID      string           `json:"id"`
+	Plan    string           `json:"plan"` // Empty uses consumers.default_plan
+	Keys    []api_credential `json:"keys"`
+	Created time.Time        `json:"created"`
+}
+
+type api_credential struct {
+	Hash    string    `json:"hash"`   // sha256 of the key, the key itself is only shown once
+	Prefix  string    `json:"prefix"` // Start of the key, to tell keys apart in the admin API
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // Old keys kept for a grace period after a rotation
+}
+
+type usage_counter struct {
+	Day        string `json:"day"` // 2006-01-02
+	DayCount   int64  `json:"day_count"`
+	Month      string `json:"month"` // 2006-01
+	MonthCount int64  `json:"month_count"`
+}
+
+// What goes into consumers.file
+type consumer_file struct {
+	Consumers map[string]*managed_consumer `json:"consumers"`
+	Usage     map[string]*usage_counter    `json:"usage"`
+}
+
+// Managed consumers and the usage of every consumer, managed or not. Lives across config reloads.
+type consumer_store struct {
+	mu        sync.Mutex
+	path      string
+	consumers map[string]*managed_consumer
+	by_key    map[string]string // Key hash -> consumer id
+	usage     map[string]*usage_counter
+	dirty     bool // Something changed since the last flush
+}
+
+var consumer_db = &consumer_store{
+	consumers: make(map[string]*managed_consumer),
+	by_key:    make(map[string]string),
+	usage:     make(map[string]*usage_counter),
+}
+
+var start_consumer_flusher sync.Once
+
+// Points the store at the configured file. Switching files writes out the old one first. A file that
+// can't be read is logged and left alone so it doesn't get overwritten.
+func apply_consumers_config(cc consumers_config) {
+	start_consumer_flusher.Do(func() {
+		go flush_consumers()
+	})
+	consumer_db.mu.Lock()
+	same := consumer_db.path == cc.File
+	consumer_db.mu.Unlock()
+	if same {
+		return
+	}
+	if err := consumer_db.flush(); err != nil {
+		log.Printf("[ERROR] Could not save consumers: %v", err)
+	}
+	if err := consumer_db.open(cc.File); err != nil {
+		log.Printf("[ERROR] Could not load consumers from %s, keeping them in memory only: %v", cc.File, err)
+	}
+}
+
+func (cs *consumer_store) open(path string) error {
+	loaded := consumer_file{Consumers: map[string]*managed_consumer{}, Usage: map[string]*usage_counter{}}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &loaded); err != nil {
+				return err
+			}
+		}
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.path = path
+	cs.consumers = loaded.Consumers
+	cs.usage = loaded.Usage
+	if cs.consumers == nil {
+		cs.consumers = map[string]*managed_consumer{}
+	}
+	if cs.usage == nil {
+		cs.usage = map[string]*usage_counter{}
+	}
+	cs.by_key = make(map[string]string)
+	for id, mc := range cs.consumers {
+		for _, k := range mc.Keys {
+			cs.by_key[k.Hash] = id
+		}
+	}
+	if path != "" {
+		log.Printf("Loaded %d consumers from %s", len(cs.consumers), path)
+	}
+	return nil
+}
+
+// Writes the file if anything changed. Write to a temporary file and rename, so a crash mid write
+// leaves the previous version.
+func (cs *consumer_store) flush() error {
+	cs.mu.Lock()
+	if !cs.dirty || cs.path == "" {
+		cs.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(consumer_file{Consumers: cs.consumers, Usage: cs.usage}, "", "  ")
+	path := cs.path
+	cs.dirty = false
+	cs.mu.Unlock()
+	if err == nil {
+		err = write_file_atomically(path, data)
+	}
+	if err != nil {
+		cs.mu.Lock()
+		cs.dirty = true // Try again next time
+		cs.mu.Unlock()
+	}
+	return err
+}
+
+func write_file_atomically(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Saves usage every flush_interval. main saves once more when the gateway stops.
+func flush_consumers() {
+	for {
+		time.Sleep(time.Duration(cfg().Consumers.FlushInterval))
+		save_consumers()
+	}
+}
+
+func save_consumers() {
+	if err := consumer_db.flush(); err != nil {
+		log.Printf("[ERROR] Could not save consumers: %v", err)
+	}
+}
+
+func key_hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// A fresh key and the credential that stores it
+func new_api_key(now time.Time) (string, api_credential) {
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	key := "gw_" + hex.EncodeToString(raw)
+	return key, api_credential{Hash: key_hash(key), Prefix: key[:11], Created: now}
+}
+
+// Consumer id for an API key, empty if the key is unknown or past its grace period
+func (cs *consumer_store) lookup(key string, now time.Time) string {
+	hash := key_hash(key)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	id, ok := cs.by_key[hash]
+	if !ok {
+		return ""
+	}
+	for _, k := range cs.consumers[id].Keys {
+		if k.Hash == hash && (k.Expires.IsZero() || now.Before(k.Expires)) {
+			return id
+		}
+	}
+	return ""
+}
+
+var err_consumer_exists = errors.New("consumer already exists")
+var err_unknown_consumer = errors.New("unknown consumer")
+
+// Creates a consumer with one key and returns the key
+func (cs *consumer_store) create(id, plan string, now time.Time) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, exists := cs.consumers[id]; exists {
+		return "", err_consumer_exists
+	}
+	key, credential := new_api_key(now)
+	cs.consumers[id] = &managed_consumer{ID: id, Plan: plan, Keys: []api_credential{credential}, Created: now}
+	cs.by_key[credential.Hash] = id
+	cs.dirty = true
+	return key, nil
+}
+
+// Issues a new key. The old ones keep working for grace, or stop right away when grace is 0.
+func (cs *consumer_store) rotate(id string, grace time.Duration, now time.Time) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	mc, ok := cs.consumers[id]
+	if !ok {
+		return "", err_unknown_consumer
+	}
+	kept := []api_credential{}
+	for _, k := range mc.Keys {
+		if grace > 0 && (k.Expires.IsZero() || now.Before(k.Expires)) {
+			if k.Expires.IsZero() || now.Add(grace).Before(k.Expires) {
+				k.Expires = now.Add(grace)
+			}
+			kept = append(kept, k)
+			continue
+		}
+		delete(cs.by_key, k.Hash)
+	}
+	key, credential := new_api_key(now)
+	mc.Keys = append(kept, credential)
+	cs.by_key[credential.Hash] = id
+	cs.dirty = true
+	return key, nil
+}
+
+func (cs *consumer_store) set_plan(id, plan string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	mc, ok := cs.consumers[id]
+	if !ok {
+		return err_unknown_consumer
+	}
+	mc.Plan = plan
+	cs.dirty = true
+	return nil
+}
+
+// Removes the consumer and its keys. Its usage stays so deleting and recreating doesn't reset a quota.
+func (cs *consumer_store) remove(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	mc, ok := cs.consumers[id]
+	if !ok {
+		return err_unknown_consumer
+	}
+	for _, k := range mc.Keys {
+		delete(cs.by_key, k.Hash)
+	}
+	delete(cs.consumers, id)
+	cs.dirty = true
+	return nil
+}
+
+// Plan name of a managed consumer, empty for anyone else
+func (cs *consumer_store) plan_of(id string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if mc, ok := cs.consumers[id]; ok {
+		return mc.Plan
+	}
+	return ""
+}
+
+type quota_result struct {
+	allowed         bool
+	day_remaining   int64
+	month_remaining int64
+	retry_after     time.Duration // Until the exhausted period starts over
+}
+
+// Counts one request against the plan unless a period is used up already
+func (cs *consumer_store) take(id string, plan plan_config, now time.Time) quota_result {
+	now = now.UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	u := cs.usage[id]
+	if u == nil {
+		u = &usage_counter{}
+		cs.usage[id] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+
+	result := quota_result{allowed: true}
+	if plan.Daily > 0 && u.DayCount >= plan.Daily {
+		result.allowed = false
+		result.retry_after = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	if plan.Monthly > 0 && u.MonthCount >= plan.Monthly {
+		result.allowed = false
+		result.retry_after = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+	if result.allowed {
+		u.DayCount++
+		u.MonthCount++
+		cs.dirty = true
+	}
+	result.day_remaining = max(plan.Daily-u.DayCount, 0)
+	result.month_remaining = max(plan.Monthly-u.MonthCount, 0)
+	return result
+}
+
+// Plan that applies to a consumer: its own, else the default one. Nil means no quota.
+func (c *gateway_config) plan_for(id string) (string, *plan_config) {
+	name := consumer_db.plan_of(id)
+	if name == "" {
+		name = c.Consumers.DefaultPlan
+	}
+	plan, ok := c.Plans[name]
+	if !ok {
+		return name, nil
+	}
+	return name, &plan
+}
+
+// Checks the consumer's plan, sets the X-Quota headers and answers 429 once a period is used up.
+// Returns false when the request must stop here. Open routes and consumers without a plan pass.
+func quota_limiter(w http.ResponseWriter, request *http.Request, conf *gateway_config) bool {
+	c := current_consumer(request.Context())
+	if c == nil {
+		return true
+	}
+	name, plan := conf.plan_for(c.ID)
+	if plan == nil {
+		if name != "" {
+			log.Printf("[WARNING] Consumer %s has plan %q which is not configured, no quota applied", c.ID, name)
+		}
+		return true
+	}
+	result := consumer_db.take(c.ID, *plan, time.Now())
+	w.Header().Set("X-Quota-Plan", name)
+	if plan.Daily > 0 {
+		w.Header().Set("X-Quota-Daily-Limit", strconv.FormatInt(plan.Daily, 10))
+		w.Header().Set("X-Quota-Daily-Remaining", strconv.FormatInt(result.day_remaining, 10))
+	}
+	if plan.Monthly > 0 {
+		w.Header().Set("X-Quota-Monthly-Limit", strconv.FormatInt(plan.Monthly, 10))
+		w.Header().Set("X-Quota-Monthly-Remaining", strconv.FormatInt(result.month_remaining, 10))
+	}
+	if !result.allowed {
+		w.Header().Set("Retry-After", header_seconds(result.retry_after))
+		http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// API keys of consumers created through /admin/consumers, from X-API-Key or the api_key query parameter
+type managed_key_authenticator struct{}
+
+func (managed_key_authenticator) authenticate(r *http.Request) (*consumer, error) {
+	key := api_key(r)
+	if key == "" {
+		return nil, err_no_credentials
+	}
+	id := consumer_db.lookup(key, time.Now())
+	if id == "" {
+		return nil, errors.New("unknown API key")
+	}
+	return &consumer{ID: id}, nil
+}
+
+func (c *gateway_config) validate_plans() error {
+	var errs []error
+	for name, plan := range c.Plans {
+		if plan.Daily < 0 || plan.Monthly < 0 {
+			errs = append(errs, fmt.Errorf("plans.%s: limits can't be negative", name))
+		}
+	}
+	if p := c.Consumers.DefaultPlan; p != "" {
+		if _, ok := c.Plans[p]; !ok {
+			errs = append(errs, fmt.Errorf("consumers.default_plan: unknown plan %q", p))
+		}
+	}
+	if c.Consumers.FlushInterval <= 0 {
+		errs = append(errs, errors.New("consumers.flush_interval must be positive"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func empty_consumer_store() *consumer_store {
+	return &consumer_store{
+		consumers: make(map[string]*managed_consumer),
+		by_key:    make(map[string]string),
+		usage:     make(map[string]*usage_counter),
+	}
+}
+
+// One request at a point in time and what the quota should answer
+type quota_step struct {
+	at   time.Time
+	want quota_result
+}
+
+func TestQuotaTake(t *testing.T) {
+	at := func(day int, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	feb_1 := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		plan  plan_config
+		steps []quota_step
+	}{
+		{"daily quota starts over at UTC midnight", plan_config{Daily: 2}, []quota_step{
+			{at(15, 10, 0), quota_result{allowed: true, day_remaining: 1}},
+			{at(15, 10, 1), quota_result{allowed: true, day_remaining: 0}},
+			{at(15, 10, 2), quota_result{allowed: false, day_remaining: 0, retry_after: 13*time.Hour + 58*time.Minute}},
+			{at(15, 23, 59), quota_result{allowed: false, day_remaining: 0, retry_after: time.Minute}},
+			{at(16, 0, 0), quota_result{allowed: true, day_remaining: 1}},
+		}},
+		{"monthly quota starts over on the first", plan_config{Monthly: 2}, []quota_step{
+			{at(31, 12, 0), quota_result{allowed: true, month_remaining: 1}},
+			{at(31, 12, 0), quota_result{allowed: true, month_remaining: 0}},
+			{at(31, 12, 0), quota_result{allowed: false, month_remaining: 0, retry_after: 12 * time.Hour}},
+			{feb_1, quota_result{allowed: true, month_remaining: 1}},
+		}},
+		{"used up month waits for the month, not the day", plan_config{Daily: 5, Monthly: 3}, []quota_step{
+			{at(29, 8, 0), quota_result{allowed: true, day_remaining: 4, month_remaining: 2}},
+			{at(30, 8, 0), quota_result{allowed: true, day_remaining: 4, month_remaining: 1}},
+			{at(30, 9, 0), quota_result{allowed: true, day_remaining: 3, month_remaining: 0}},
+			{at(30, 12, 0), quota_result{allowed: false, day_remaining: 3, month_remaining: 0, retry_after: 36 * time.Hour}},
+			{at(31, 0, 0), quota_result{allowed: false, day_remaining: 5, month_remaining: 0, retry_after: 24 * time.Hour}},
+			{feb_1, quota_result{allowed: true, day_remaining: 4, month_remaining: 2}},
+		}},
+		{"other time zones count in UTC", plan_config{Daily: 1}, []quota_step{
+			{at(15, 23, 0), quota_result{allowed: true}},
+			// 01:30 on the 16th in UTC+2 is still the 15th in UTC
+			{time.Date(2024, time.January, 16, 1, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60)), quota_result{allowed: false, retry_after: 30 * time.Minute}},
+		}},
+		{"no limits", plan_config{}, []quota_step{
+			{at(15, 10, 0), quota_result{allowed: true}},
+			{at(15, 10, 0), quota_result{allowed: true}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := empty_consumer_store()
+			for i, step := range tt.steps {
+				if got := cs.take("acme", tt.plan, step.at); got != step.want {
+					t.Fatalf("step %d at %s: got %+v, want %+v", i, step.at, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Date(2024, time.January, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		graces []time.Duration // One rotation each, an hour apart
+		check  time.Duration   // When the keys are checked, after the last rotation
+		want   []bool          // Which keys work then, the original one first
+	}{
+		{"no grace", []time.Duration{0}, 0, []bool{false, true}},
+		{"within the grace period", []time.Duration{24 * time.Hour}, 23 * time.Hour, []bool{true, true}},
+		{"after the grace period", []time.Duration{24 * time.Hour}, 24 * time.Hour, []bool{false, true}},
+		{"shorter grace cuts an earlier one short", []time.Duration{24 * time.Hour, 30 * time.Minute}, 31 * time.Minute, []bool{false, false, true}},
+		{"longer grace doesn't extend an earlier one", []time.Duration{2 * time.Hour, 48 * time.Hour}, 61 * time.Minute, []bool{false, true, true}},
+		{"no grace drops every old key", []time.Duration{24 * time.Hour, 0}, 0, []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := empty_consumer_store()
+			key, err := cs.create("acme", "", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{key}
+			at := now
+			for _, grace := range tt.graces {
+				at = at.Add(time.Hour)
+				key, err := cs.rotate("acme", grace, at)
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+			for i, key := range keys {
+				if works := cs.lookup(key, at.Add(tt.check)) == "acme"; works != tt.want[i] {
+					t.Errorf("key %d works: %v, want %v", i, works, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConsumerLifecycle(t *testing.T) {
+	now := time.Date(2024, time.January, 15, 10, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "consumers.json")
+	cs := empty_consumer_store()
+	if err := cs.open(path); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := cs.create("acme", "free", now)
+	if _, err := cs.create("acme", "pro", now); err != err_consumer_exists {
+		t.Fatalf("got error %v, want err_consumer_exists", err)
+	}
+	if _, err := cs.rotate("nobody", 0, now); err != err_unknown_consumer {
+		t.Fatalf("got error %v, want err_unknown_consumer", err)
+	}
+	cs.take("acme", plan_config{Daily: 10}, now)
+	if err := cs.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart finds the consumer, its key and its usage again
+	reopened := empty_consumer_store()
+	if err := reopened.open(path); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.lookup(key, now) != "acme" || reopened.plan_of("acme") != "free" {
+		t.Fatal("consumer lost on reload")
+	}
+	if got := reopened.take("acme", plan_config{Daily: 10}, now); got.day_remaining != 8 {
+		t.Fatalf("got %+v, want the saved request counted", got)
+	}
+
+	// Deleting drops the key but not the usage, so recreating doesn't reset the quota
+	if err := reopened.remove("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.lookup(key, now) != "" {
+		t.Fatal("key still works after the consumer was deleted")
+	}
+	reopened.create("acme", "free", now)
+	if got := reopened.take("acme", plan_config{Daily: 10}, now); got.day_remaining != 7 {
+		t.Fatalf("got %+v, want usage kept across delete and create", got)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Who may use /registerServer and /exit, and where they are served
+type control_config struct {
+	// Separate listener for /registerServer, /exit, /admin/* and /debug/vars, 127.0.0.1:9090 by
+	// default. Set to null and they share the public listeners with client traffic.
+	Listener *listener_config `json:"listener"`
+
+	RequireClientCert bool              `json:"require_client_cert"` // Only callers with a certificate from the listener's client_ca_file
+	Tokens            map[string]string `json:"tokens"`              // Bearer token -> identity
+	HMACKeys          map[string]string `json:"hmac_keys"`           // Key id -> shared secret, for signed requests
+	MaxClockSkew      duration          `json:"max_clock_skew"`      // How old a signed request may be, default 5m
+	AuditLog          string            `json:"audit_log"`           // JSON lines file, empty writes [AUDIT] lines to the gateway log
+
+	// Identities that may use /admin/ and /debug/vars: certificate names, HMAC key ids or token
+	// identities. Everyone else may only register and remove servers.
+	Admins []string `json:"admins"`
+
+	// Accept control calls from anyone who reaches the control listener when no certificate, token
+	// or key is configured. Without it such a gateway refuses every control call. On by default,
+	// which together with the loopback listener lets local app servers register out of the box.
+	AllowUnauthenticated bool `json:"allow_unauthenticated"`
+}
+
+// Headers of a signed control request. The signature is a hex HMAC-SHA256 over method, path with
+// the query string, timestamp and the hex SHA-256 of the body, joined by newlines.
+const (
+	signature_key_header       = "X-Gateway-Key-Id"
+	signature_timestamp_header = "X-Gateway-Timestamp" // Unix seconds
+	signature_header           = "X-Gateway-Signature"
+)
+
+// Control requests are tiny, anything bigger is not one of ours
+const max_control_body = 64 << 10
+
+func (cc *control_config) validate(public []listener_config) error {
+	var errs []error
+	if cc.Listener != nil {
+		if err := cc.Listener.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("listener: %w", err))
+		}
+		if cc.Listener.RedirectTo != "" {
+			errs = append(errs, errors.New("listener can't be a redirect listener"))
+		}
+		if slices.ContainsFunc(public, func(l listener_config) bool { return l.Addr == cc.Listener.Addr }) {
+			errs = append(errs, fmt.Errorf("listener %s is already a public listener", cc.Listener.Addr))
+		}
+	}
+	if cc.RequireClientCert {
+		serving := public
+		if cc.Listener != nil {
+			serving = []listener_config{*cc.Listener}
+		}
+		if !slices.ContainsFunc(serving, func(l listener_config) bool { return l.TLS.ClientCAFile != "" }) {
+			errs = append(errs, errors.New("require_client_cert needs tls.client_ca_file on the listener serving the control endpoints"))
+		}
+	}
+	for token, identity := range cc.Tokens {
+		if len(token) < 16 || identity == "" {
+			errs = append(errs, errors.New("tokens need at least 16 characters and an identity"))
+			break
+		}
+	}
+	for id, secret := range cc.HMACKeys {
+		if len(secret) < 16 {
+			errs = append(errs, fmt.Errorf("hmac_keys.%s: secret needs at least 16 characters", id))
+		}
+	}
+	if cc.AllowUnauthenticated && cc.Listener == nil && !cc.authenticated() {
+		errs = append(errs, errors.New("allow_unauthenticated needs a listener, the public listeners never take unauthenticated control calls"))
+	}
+	if cc.MaxClockSkew <= 0 {
+		errs = append(errs, errors.New("max_clock_skew must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// Any way of proving who is calling configured at all
+func (cc *control_config) authenticated() bool {
+	return cc.RequireClientCert || len(cc.Tokens) > 0 || len(cc.HMACKeys) > 0
+}
+
+// Says at startup when control calls are open to anyone or refused outright
+func (cc *control_config) warn_unauthenticated() {
+	switch {
+	case cc.authenticated():
+		if len(cc.Admins) == 0 {
+			log.Println("[WARNING] No control.admins, /admin/ and /debug/vars will refuse every caller")
+		}
+	case cc.AllowUnauthenticated:
+		log.Printf("[WARNING] control.allow_unauthenticated is on, anyone who reaches %s can register servers and use /admin/", cc.Listener.Addr)
+	default:
+		log.Println("[WARNING] No control.tokens, hmac_keys or require_client_cert, every control call will be refused")
+	}
+}
+
+// Who called a control endpoint and how they proved it
+type control_caller struct {
+	identity string // Empty when the control plane is open
+	method   string // certificate, hmac or token
+}
+
+// Identity for a control endpoint call: a verified client certificate, then a signed request, then
+// a bearer token. Writes a 401 and returns false when the caller proves nothing and the control
+// plane isn't explicitly open, or presents credentials that don't check out. The body stays
+// readable for the handler.
+func control_identity(w http.ResponseWriter, r *http.Request) (control_caller, bool) {
+	cc := cfg().Control
+	body, err := io.ReadAll(io.LimitReader(r.Body, max_control_body))
+	if err != nil {
+		http.Error(w, "Could not read the body", http.StatusBadRequest)
+		return control_caller{}, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	caller, err := control_caller_of(&cc, r, body, time.Now())
+	if err == nil && caller.identity == "" {
+		switch {
+		case cc.authenticated():
+			err = errors.New("no client certificate, signature or token")
+		case !cc.AllowUnauthenticated:
+			err = errors.New("no control credentials configured and allow_unauthenticated is off")
+		}
+	}
+	if err != nil {
+		audit(r, caller, audit_entry{Outcome: "denied", Reason: err.Error()})
+		log.Printf("[WARNING] Control call %s from %s denied: %v", r.URL.Path, client_ip(r), err)
+		if cc.Listener == nil {
+			conf := cfg()
+			bans.strike(client_ip(r), &conf.AutoBan, time.Now()) // Guessing credentials on a public listener
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return control_caller{}, false
+	}
+	return caller, true
+}
+
+// control_identity for /admin/ and /debug/vars: writes a 403 and returns false unless the caller
+// is in control.admins. An open control plane has no identities to tell apart, everyone is an
+// admin there.
+func control_admin(w http.ResponseWriter, r *http.Request) (control_caller, bool) {
+	caller, ok := control_identity(w, r)
+	if !ok {
+		return caller, false
+	}
+	cc := cfg().Control
+	if cc.authenticated() && !slices.Contains(cc.Admins, caller.identity) {
+		audit(r, caller, audit_entry{Outcome: "denied", Reason: "not in control.admins"})
+		log.Printf("[WARNING] Control call %s from %s as %q denied: not in control.admins", r.URL.Path, client_ip(r), caller.identity)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return control_caller{}, false
+	}
+	return caller, true
+}
+
+// Control endpoints that share a public listener get the ban and rate limit checks that routes
+// with auth get, so nobody can guess credentials at full speed
+func publicControlMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !not_banned(w, r) {
+			return
+		}
+		conf := cfg()
+		if !rate_limiter(w, r, &route{Prefix: r.URL.Path}, conf.RateLimits[conf.AuthRateLimit]) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func control_caller_of(cc *control_config, r *http.Request, body []byte, now time.Time) (control_caller, error) {
+	if identity := cert_identity(r); identity != "" {
+		return control_caller{identity: identity, method: "certificate"}, nil
+	}
+	if cc.RequireClientCert {
+		return control_caller{}, errors.New("client certificate required")
+	}
+	if key_id := r.Header.Get(signature_key_header); key_id != "" {
+		caller := control_caller{identity: key_id, method: "hmac"}
+		return caller, cc.check_signature(r, key_id, body, now)
+	}
+	if token := bearer_token(r); token != "" {
+		for known, identity := range cc.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+				return control_caller{identity: identity, method: "token"}, nil
+			}
+		}
+		return control_caller{method: "token"}, errors.New("unknown token")
+	}
+	return control_caller{}, nil
+}
+
+// Signature the caller should have sent, see signature_header
+func control_signature(secret, method, request_uri, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, request_uri, timestamp, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cc *control_config) check_signature(r *http.Request, key_id string, body []byte, now time.Time) error {
+	secret, ok := cc.HMACKeys[key_id]
+	if !ok {
+		return fmt.Errorf("unknown key %q", key_id)
+	}
+	timestamp := r.Header.Get(signature_timestamp_header)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("bad timestamp")
+	}
+	skew := time.Duration(cc.MaxClockSkew)
+	signed := time.Unix(seconds, 0)
+	if signed.Before(now.Add(-skew)) || signed.After(now.Add(skew)) {
+		return errors.New("timestamp outside max_clock_skew")
+	}
+	want := control_signature(secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	got := r.Header.Get(signature_header)
+	if !hmac.Equal([]byte(want), []byte(got)) {
+		return errors.New("bad signature")
+	}
+	if !seen_signatures.first_use(got, signed.Add(skew), now) {
+		return errors.New("replayed request")
+	}
+	return nil
+}
+
+// Signatures accepted recently. A signed request can only be used once while its timestamp is
+// still acceptable, after that the clock check rejects it anyway.
+type signature_cache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Signature -> when it stops mattering
+}
+
+var seen_signatures = &signature_cache{seen: make(map[string]time.Time)}
+
+func (sc *signature_cache) first_use(signature string, until, now time.Time) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for s, expires := range sc.seen {
+		if now.After(expires) {
+			delete(sc.seen, s)
+		}
+	}
+	if _, used := sc.seen[signature]; used {
+		return false
+	}
+	sc.seen[signature] = until
+	return true
+}
+
+// One line of the audit log
+type audit_entry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`  // register, exit, or what was done to a consumer
+	Outcome    string    `json:"outcome"` // ok, denied (not allowed) or rejected (bad request)
+	Identity   string    `json:"identity,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Remote     string    `json:"remote"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Server     string    `json:"server,omitempty"` // Port that keys the server
+	URL        string    `json:"url,omitempty"`
+	Pool       string    `json:"pool,omitempty"`
+	Consumer   string    `json:"consumer,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+var control_actions = map[string]string{"/registerServer": "register", "/exit": "exit"}
+
+// Records a control call, whatever its outcome
+func audit(r *http.Request, caller control_caller, e audit_entry) {
+	e.Time = time.Now().UTC()
+	if e.Action == "" {
+		e.Action = control_actions[r.URL.Path]
+	}
+	if e.Action == "" {
+		e.Action = r.Method + " " + r.URL.Path
+	}
+	e.Identity = caller.identity
+	e.AuthMethod = caller.method
+	e.Remote = client_ip(r)
+	e.RequestID = request_id(r.Context())
+	line, _ := json.Marshal(e)
+	audit_log.write(cfg().Control.AuditLog, line)
+}
+
+type audit_writer struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var audit_log = &audit_writer{}
+
+// Appends to the file, reopening it when the config points somewhere else. If the file can't be
+// written the line goes to the gateway log so nothing is lost.
+func (aw *audit_writer) write(path string, line []byte) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if path != aw.path {
+		if aw.file != nil {
+			aw.file.Close()
+			aw.file = nil
+		}
+		aw.path = path
+		if path != "" {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				log.Printf("[ERROR] Could not open audit log %s: %v", path, err)
+			}
+			aw.file = f
+		}
+	}
+	if aw.file != nil {
+		_, err := aw.file.Write(append(line, '\n'))
+		if err == nil {
+			return
+		}
+		log.Printf("[ERROR] Could not write audit log %s: %v", aw.path, err)
+	}
+	log.Printf("[AUDIT] %s", line)
+}
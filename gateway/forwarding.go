@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Parses lists like trusted_proxies and allow_ips, which hold CIDRs or bare IPs
+func parse_cidrs(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("bad IP %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Whether ip falls in any of the prefixes. IPv4 mapped IPv6 addresses count as IPv4.
+func contains_ip(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *gateway_config) fill_trusted_proxies() {
+	c.trusted, _ = parse_cidrs(c.TrustedProxies) // validate reports bad entries
+}
+
+func (c *gateway_config) is_trusted(ip string) bool {
+	return contains_ip(c.trusted, ip)
+}
+
+// Address of whoever opened the connection to us
+func peer_ip(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		// RemoteAddr might already be just an IP (rare), so fall back:
+		ip = request.RemoteAddr
+	}
+	return ip
+}
+
+// The real client. Behind a trusted load balancer that is the rightmost X-Forwarded-For entry
+// not added by one of our own proxies, anything further left could have been made up by the client.
+func client_ip(request *http.Request) string {
+	c := cfg()
+	ip := peer_ip(request)
+	if !c.is_trusted(ip) {
+		return ip
+	}
+	hops := forwarded_for(request)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hops[i]
+		if !c.is_trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Every X-Forwarded-For entry, leftmost first
+func forwarded_for(request *http.Request) []string {
+	var hops []string
+	for _, value := range request.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// Sets X-Forwarded-*, Forwarded, X-Request-ID and X-Consumer-ID on the upstream request. What the client sent is
+// only kept when it came through a trusted proxy, otherwise it is thrown away.
+func set_forwarding_headers(out *http.Request, in *http.Request) {
+	peer := peer_ip(in)
+	trusted := cfg().is_trusted(peer)
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	hops := []string{}
+	forwarded := []string{}
+	if trusted {
+		hops = forwarded_for(in)
+		forwarded = in.Header.Values("Forwarded")
+		if p := in.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	}
+	out.Header.Set("X-Forwarded-For", strings.Join(append(hops, peer), ", "))
+	out.Header.Set("X-Forwarded-Proto", proto)
+	if host := in.Header.Get("X-Forwarded-Host"); trusted && host != "" {
+		out.Header.Set("X-Forwarded-Host", host)
+	} else {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+
+	// RFC 7239, IPv6 addresses are quoted and bracketed
+	node := peer
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	element := fmt.Sprintf("for=%s;proto=%s;host=%q", node, proto, in.Host)
+	out.Header.Del("Forwarded")
+	out.Header.Set("Forwarded", strings.Join(append(forwarded, element), ", "))
+
+	out.Header.Set(request_id_header, request_id(in.Context()))
+	out.Header.Del(consumer_header) // Only we get to say who the consumer is
+	if c := current_consumer(in.Context()); c != nil {
+		out.Header.Set(consumer_header, c.ID)
+	}
+}
+
+// Tells the upstream who the gateway authenticated
+const consumer_header = "X-Consumer-ID"
+
+const request_id_header = "X-Request-ID"
+
+// Per request details the logging middleware prints once the request is done. Filled in as the
+// request makes its way through, hence a pointer.
+type request_info struct {
+	id       string
+	consumer string // Set by authenticate
+}
+
+type request_info_key struct{}
+
+func request_info_from(ctx context.Context) *request_info {
+	info, _ := ctx.Value(request_info_key{}).(*request_info)
+	return info
+}
+
+func request_id(ctx context.Context) string {
+	if info := request_info_from(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// Authenticated consumer for the logs, "-" for anonymous requests
+func request_consumer(ctx context.Context) string {
+	if info := request_info_from(ctx); info != nil && info.consumer != "" {
+		return info.consumer
+	}
+	return "-"
+}
+
+// Keeps the caller's request ID if it looks sane, otherwise makes one up. Either way it goes back
+// in the response, into the context for logging and onto the trace.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(request_id_header)
+		if !valid_request_id(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(request_id_header, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), request_info_key{}, &request_info{id: id})))
+	})
+}
+
+// Printable ASCII without spaces, short enough to be safe in logs and headers
+func valid_request_id(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Makes the listed proxies trusted for the test
+func trust_proxies(t *testing.T, proxies ...string) {
+	t.Helper()
+	conf := default_config()
+	conf.TrustedProxies = proxies
+	conf.fill_trusted_proxies()
+	use_config(t, conf)
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string // X-Forwarded-For header lines
+		want      string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer can't claim another address", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"rightmost untrusted hop wins", "10.0.0.2:5000", []string{"6.6.6.6, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"hops over several headers", "10.0.0.2:5000", []string{"6.6.6.6", "198.51.100.1,10.0.0.3"}, "198.51.100.1"},
+		{"trusted proxy without the header", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"only trusted hops", "10.0.0.2:5000", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"single trusted address", "192.0.2.10:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 peer", "[2001:db8::1]:5000", []string{"198.51.100.1"}, "2001:db8::1"},
+		{"IPv4 mapped peer counts as IPv4", "[::ffff:10.0.0.2]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trust_proxies(t, "10.0.0.0/8", "192.0.2.10")
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := client_ip(r); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		peer      string
+		proto     string // X-Forwarded-Proto the client sent
+		want_xff  string
+		want_fwd  string
+		want_prot string
+	}{
+		{"untrusted peer's headers are dropped", "203.0.113.7:5000", "https",
+			"203.0.113.7", `for=203.0.113.7;proto=http;host="api.example.com"`, "http"},
+		{"trusted proxy's headers are kept", "10.0.0.2:5000", "https",
+			"198.51.100.1, 10.0.0.2", `for=198.51.100.1, for=10.0.0.2;proto=https;host="api.example.com"`, "https"},
+		{"IPv6 in Forwarded is quoted", "[2001:db8::1]:5000", "",
+			"2001:db8::1", `for="[2001:db8::1]";proto=http;host="api.example.com"`, "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trust_proxies(t, "10.0.0.0/8")
+			in := httptest.NewRequest("GET", "http://api.example.com/", nil)
+			in.RemoteAddr = tt.peer
+			in.Header.Set("X-Forwarded-For", "198.51.100.1")
+			in.Header.Set("Forwarded", "for=198.51.100.1")
+			if tt.proto != "" {
+				in.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			in.Header.Set(consumer_header, "admin")
+			out := httptest.NewRequest("GET", "http://upstream/", nil)
+			out.Header = in.Header.Clone()
+			set_forwarding_headers(out, in)
+			if got := out.Header.Get("X-Forwarded-For"); got != tt.want_xff {
+				t.Errorf("X-Forwarded-For: got %q, want %q", got, tt.want_xff)
+			}
+			if got := out.Header.Get("Forwarded"); got != tt.want_fwd {
+				t.Errorf("Forwarded: got %q, want %q", got, tt.want_fwd)
+			}
+			if got := out.Header.Get("X-Forwarded-Proto"); got != tt.want_prot {
+				t.Errorf("X-Forwarded-Proto: got %q, want %q", got, tt.want_prot)
+			}
+			if out.Header.Get(consumer_header) != "" {
+				t.Error("client's consumer header went upstream")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Virtual nodes per unit of weight. More nodes spread keys more evenly across servers.
+const ring_replicas = 100
+
+type ring_entry struct {
+	hash   uint64
+	server *server_struct
+}
+
+// Ring hash: the same key keeps landing on the same server, and a server joining or
+// leaving only moves the keys next to its own points on the ring
+type ring_hash_balancer struct {
+	server_list
+	hash_on string
+	ring    []ring_entry
+}
+
+func hash_string(text string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	return h.Sum64()
+}
+
+func (b *ring_hash_balancer) Add(s *server_struct) {
+	b.server_list.Add(s)
+	b.rebuild()
+}
+
+func (b *ring_hash_balancer) Remove(s *server_struct) {
+	b.server_list.Remove(s)
+	b.rebuild()
+}
+
+// Points only depend on the server URL and its registered weight, never on load or slow start,
+// so rebuilding gives the surviving servers exactly the same positions
+func (b *ring_hash_balancer) rebuild() {
+	ring := make([]ring_entry, 0, len(b.server_list)*ring_replicas)
+	for _, s := range b.server_list {
+		replicas := ring_replicas * max(s.weight, 1)
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ring_entry{hash: hash_string(s.URL + "#" + strconv.Itoa(i)), server: s})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.ring = ring
+}
+
+func (b *ring_hash_balancer) Pick(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	if len(b.ring) == 0 {
+		return nil
+	}
+	key, ok := hash_key(r, b.hash_on)
+	if !ok {
+		// Nothing to hash on, any server will do
+		return weighted_random(b.server_list.usable(usable))
+	}
+	h := hash_string(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	// Walk clockwise past servers that are down so only their keys move
+	for i := 0; i < len(b.ring); i++ {
+		entry := b.ring[(start+i)%len(b.ring)]
+		if usable(entry.server) {
+			return entry.server
+		}
+	}
+	return nil
+}
+
+// Checks a hash_on setting: client_ip, header:<name>, cookie:<name> or path_segment:<n>
+func validate_hash_on(hash_on string) error {
+	kind, arg, _ := strings.Cut(hash_on, ":")
+	switch kind {
+	case "client_ip":
+		return nil
+	case "header", "cookie":
+		if arg != "" {
+			return nil
+		}
+	case "path_segment":
+		if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad hash_on %q, want client_ip, header:<name>, cookie:<name> or path_segment:<n>", hash_on)
+}
+
+// Pulls the value to hash out of the request, false when the request doesn't carry one
+func hash_key(r *http.Request, hash_on string) (string, bool) {
+	kind, arg, _ := strings.Cut(hash_on, ":")
+	switch kind {
+	case "client_ip":
+		return client_ip(r), true
+	case "header":
+		value := r.Header.Get(arg)
+		return value, value != ""
+	case "cookie":
+		c, err := r.Cookie(arg)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return c.Value, true
+	case "path_segment":
+		n, _ := strconv.Atoi(arg)
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n >= len(segments) || segments[n] == "" {
+			return "", false
+		}
+		return segments[n], true
+	}
+	return "", false
+}
+
+// Cookie based stickiness: the first response pins the client to a server, later requests
+// follow the cookie for as long as that server stays available
+type sticky_config struct {
+	Cookie string   `json:"cookie"`
+	TTL    duration `json:"ttl"` // 0 makes it a session cookie
+}
+
+const default_sticky_cookie = "GW_STICKY"
+
+func (sc *sticky_config) cookie_name() string {
+	if sc.Cookie == "" {
+		return default_sticky_cookie
+	}
+	return sc.Cookie
+}
+
+// Opaque id for the sticky cookie so clients never see backend addresses
+func (s *server_struct) sticky_id() string {
+	return strconv.FormatUint(hash_string(s.URL), 36)
+}
+
+// Server the request's sticky cookie points at, if it is still usable. Caller holds the pool lock.
+func (p *upstream_pool) sticky_server(r *http.Request, usable func(*server_struct) bool) *server_struct {
+	if p.sticky == nil || r == nil {
+		return nil
+	}
+	c, err := r.Cookie(p.sticky.cookie_name())
+	if err != nil {
+		return nil
+	}
+	for _, s := range p.servers {
+		if s.sticky_id() == c.Value && usable(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (p *upstream_pool) sticky_settings() *sticky_config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sticky
+}
+
+// Pins the client to server unless its cookie already does
+func set_sticky_cookie(w http.ResponseWriter, r *http.Request, sc *sticky_config, server *server_struct) {
+	if sc == nil {
+		return
+	}
+	id := server.sticky_id()
+	if c, err := r.Cookie(sc.cookie_name()); err == nil && c.Value == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     sc.cookie_name(),
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sc.TTL > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(sc.TTL))
+		cookie.MaxAge = int(time.Duration(sc.TTL).Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
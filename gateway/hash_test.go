@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Where each of n user ids lands, by port
+func ring_placement(t *testing.T, b *ring_hash_balancer, usable func(*server_struct) bool, n int) map[string]string {
+	t.Helper()
+	placement := make(map[string]string, n)
+	for i := range n {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", "user-"+strconv.Itoa(i))
+		s := b.Pick(r, usable)
+		if s == nil {
+			t.Fatal("no server picked")
+		}
+		placement[r.Header.Get("X-User")] = s.port
+	}
+	return placement
+}
+
+func TestRingHashRemapping(t *testing.T) {
+	const keys = 2000
+	tests := []struct {
+		name    string
+		change  func(b *ring_hash_balancer, servers []*server_struct) func(*server_struct) bool
+		moved   string  // Port every moved key has to move to or from
+		from    bool    // Whether moved keys left that port rather than went to it
+		at_most float64 // Share of the keys allowed to move
+	}{
+		{"server added", func(b *ring_hash_balancer, servers []*server_struct) func(*server_struct) bool {
+			b.Add(servers[3])
+			return any_server
+		}, "4", false, 0.4},
+		{"server removed", func(b *ring_hash_balancer, servers []*server_struct) func(*server_struct) bool {
+			b.Remove(servers[0])
+			return any_server
+		}, "1", true, 0.5},
+		{"server down", func(b *ring_hash_balancer, servers []*server_struct) func(*server_struct) bool {
+			return func(s *server_struct) bool { return s != servers[1] }
+		}, "2", true, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := test_servers(1, 1, 1, 1)
+			for _, s := range servers {
+				s.URL = "http://10.0.0." + s.port + ":8080"
+			}
+			b := &ring_hash_balancer{hash_on: "header:X-User"}
+			for _, s := range servers[:3] {
+				b.Add(s)
+			}
+			before := ring_placement(t, b, any_server, keys)
+			after := ring_placement(t, b, tt.change(b, servers), keys)
+			moved := 0
+			for key, port := range before {
+				if after[key] == port {
+					continue
+				}
+				moved++
+				if (tt.from && port != tt.moved) || (!tt.from && after[key] != tt.moved) {
+					t.Fatalf("%s moved from %s to %s", key, port, after[key])
+				}
+			}
+			if moved == 0 || float64(moved)/keys > tt.at_most {
+				t.Fatalf("%d of %d keys moved", moved, keys)
+			}
+		})
+	}
+}
+
+func TestRingHashWithoutKey(t *testing.T) {
+	b := &ring_hash_balancer{hash_on: "cookie:session"}
+	for _, s := range test_servers(1, 1) {
+		s.URL = "http://10.0.0." + s.port + ":8080"
+		b.Add(s)
+	}
+	if b.Pick(httptest.NewRequest("GET", "/", nil), any_server) == nil {
+		t.Fatal("request without the cookie got no server")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opaque bearer tokens checked against an RFC 7662 introspection endpoint. Answers are cached so
+// the authorization server is not asked on every request: active tokens until cache_ttl or their
+// own exp, whichever comes first, inactive ones for negative_cache_ttl.
+type introspection_authenticator struct {
+	settings authenticator_config
+	client   *http.Client
+	mu       sync.Mutex
+	cache    map[string]introspection_entry // sha256 of the token, we don't keep tokens around
+}
+
+type introspection_entry struct {
+	claims  map[string]any // nil for inactive tokens
+	expires time.Time
+}
+
+const introspection_cache_size = 10000
+
+func new_introspection_authenticator(ac authenticator_config) (*introspection_authenticator, error) {
+	if _, err := url.ParseRequestURI(ac.IntrospectionURL); err != nil {
+		return nil, errors.New("introspection needs a valid introspection_url")
+	}
+	if ac.CacheTTL <= 0 {
+		ac.CacheTTL = duration(time.Minute)
+	}
+	if ac.NegativeCacheTTL <= 0 {
+		ac.NegativeCacheTTL = duration(10 * time.Second)
+	}
+	return &introspection_authenticator{
+		settings: ac,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		cache:    make(map[string]introspection_entry),
+	}, nil
+}
+
+func (ia *introspection_authenticator) authenticate(r *http.Request) (*consumer, error) {
+	token := bearer_token(r)
+	if token == "" {
+		return nil, err_no_credentials
+	}
+	claims, err := ia.introspect(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	id := ""
+	for _, claim := range []string{ia.settings.ConsumerClaim, "sub", "username", "client_id"} {
+		if value, _ := claims[claim].(string); claim != "" && value != "" {
+			id = value
+			break
+		}
+	}
+	if id == "" {
+		return nil, errors.New("introspection result names no subject")
+	}
+	return &consumer{ID: id, Claims: claims}, nil
+}
+
+func (ia *introspection_authenticator) introspect(token string, now time.Time) (map[string]any, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	ia.mu.Lock()
+	entry, cached := ia.cache[key]
+	ia.mu.Unlock()
+	if cached && now.Before(entry.expires) {
+		if entry.claims == nil {
+			return nil, errors.New("token is not active")
+		}
+		return entry.claims, nil
+	}
+
+	claims, err := ia.call(token)
+	if err != nil {
+		return nil, err // Not cached, the next request tries again
+	}
+	entry = introspection_entry{expires: now.Add(time.Duration(ia.settings.NegativeCacheTTL))}
+	if active, _ := claims["active"].(bool); active {
+		entry = introspection_entry{claims: claims, expires: now.Add(time.Duration(ia.settings.CacheTTL))}
+		if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(entry.expires) {
+			entry.expires = time.Unix(int64(exp), 0)
+		}
+	}
+	ia.store(key, entry, now)
+	if entry.claims == nil {
+		return nil, errors.New("token is not active")
+	}
+	return claims, nil
+}
+
+// Keeps the cache bounded: expired entries go first, then whatever map order gives us
+func (ia *introspection_authenticator) store(key string, entry introspection_entry, now time.Time) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	if len(ia.cache) >= introspection_cache_size {
+		for k, e := range ia.cache {
+			if now.After(e.expires) {
+				delete(ia.cache, k)
+			}
+		}
+		for k := range ia.cache {
+			if len(ia.cache) < introspection_cache_size {
+				break
+			}
+			delete(ia.cache, k)
+		}
+	}
+	ia.cache[key] = entry
+}
+
+func (ia *introspection_authenticator) call(token string) (map[string]any, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, ia.settings.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ia.settings.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(ia.settings.ClientID), url.QueryEscape(ia.settings.ClientSecret))
+	}
+	// Whatever goes wrong here says nothing about the token, only about the endpoint
+	resp, err := ia.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection: %w: %w", err_auth_unavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection: %w: status %s", err_auth_unavailable, resp.Status)
+	}
+	claims := map[string]any{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("introspection: %w: %w", err_auth_unavailable, err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Makes conf the current config for the test and puts the old one back afterwards
+func use_config(t *testing.T, conf *gateway_config) {
+	t.Helper()
+	previous := current_config.Load()
+	current_config.Store(conf)
+	t.Cleanup(func() { current_config.Store(previous) })
+}
+
+// Starts the test with nobody banned
+func fresh_bans(t *testing.T) {
+	t.Helper()
+	previous := bans
+	bans = &ban_tracker{clients: make(map[string]*ban_state)}
+	t.Cleanup(func() { bans = previous })
+}
+
+// A config with one introspection authenticator against url, banning on the first failed login
+func introspection_config(url string) *gateway_config {
+	conf := default_config()
+	conf.Authenticators = map[string]authenticator_config{"opaque": {Type: "introspection", IntrospectionURL: url}}
+	conf.AutoBan = ban_config{Threshold: 1, Window: duration(time.Minute), Duration: duration(time.Minute)}
+	conf.fill_authenticators()
+	return conf
+}
+
+func TestIntrospectionOutcomes(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc // nil for an endpoint that is down
+		status    int              // 0 when the request gets through
+		challenge string
+		banned    bool
+	}{
+		{"active", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"active":true,"sub":"alice"}`)
+		}, 0, "", false},
+		{"inactive", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"active":false}`)
+		}, http.StatusUnauthorized, `Bearer error="invalid_token"`, true},
+		{"no subject", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"active":true}`)
+		}, http.StatusUnauthorized, `Bearer error="invalid_token"`, true},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down for maintenance", http.StatusBadGateway)
+		}, http.StatusServiceUnavailable, "", false},
+		{"endpoint rejects the gateway", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad client credentials", http.StatusUnauthorized)
+		}, http.StatusServiceUnavailable, "", false},
+		{"garbage answer", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `<html>`)
+		}, http.StatusServiceUnavailable, "", false},
+		{"unreachable", nil, http.StatusServiceUnavailable, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fresh_bans(t)
+			endpoint := httptest.NewServer(tt.handler)
+			if tt.handler == nil {
+				endpoint.Close() // Connections get refused from here on
+			} else {
+				defer endpoint.Close()
+			}
+			conf := introspection_config(endpoint.URL)
+			use_config(t, conf)
+
+			r := httptest.NewRequest("GET", "/api", nil)
+			r.Header.Set("Authorization", "Bearer opaque-token")
+			w := httptest.NewRecorder()
+			passed := authenticate(w, r, conf, &route{Auth: []string{"opaque"}}) != nil
+			if passed != (tt.status == 0) || (tt.status != 0 && w.Code != tt.status) {
+				t.Fatalf("got passed=%v status %d", passed, w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Fatalf("got challenge %q, want %q", got, tt.challenge)
+			}
+			if banned := bans.remaining(client_ip(r), time.Now()) > 0; banned != tt.banned {
+				t.Fatalf("got banned=%v", banned)
+			}
+		})
+	}
+}
+
+func TestIntrospectionCacheSurvivesReload(t *testing.T) {
+	var calls atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.WriteString(w, `{"active":true,"sub":"alice"}`)
+	}))
+	defer endpoint.Close()
+
+	ask := func(conf *gateway_config) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api", nil)
+		r.Header.Set("Authorization", "Bearer opaque-token")
+		if _, err := conf.authenticators["opaque"].authenticate(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := introspection_config(endpoint.URL)
+	ask(first)
+	same := introspection_config(endpoint.URL)
+	same.keep_authenticators(first)
+	ask(same)
+	if calls.Load() != 1 {
+		t.Fatalf("%d calls to the endpoint, want the reloaded config to use the cache", calls.Load())
+	}
+	// Different settings mean a fresh authenticator
+	changed := introspection_config(endpoint.URL + "/")
+	changed.keep_authenticators(same)
+	ask(changed)
+	if calls.Load() != 2 {
+		t.Fatalf("%d calls to the endpoint, want a fresh cache after the settings changed", calls.Load())
+	}
+	if changed.authenticators["opaque"] == same.authenticators["opaque"] {
+		t.Fatal("authenticator kept although its settings changed")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms we verify. "none" is never accepted.
+var jwt_hashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+type jwt_header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// One key from a JWKS document, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`   // RSA
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`   // EC
+	Y   string `json:"y"`   // EC
+	K   string `json:"k"`   // oct, for HMAC
+}
+
+type verification_key struct {
+	kid string
+	key any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k jwk) public_key() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64(k.N)
+		e, err2 := b64(k.E)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("bad RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, errors.New("bad EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return b64(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func parse_jwks(data []byte) ([]verification_key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("bad JWKS: %w", err)
+	}
+	keys := []verification_key{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.public_key()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, verification_key{kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+// Keys fetched from a JWKS endpoint. Refreshed after ttl, or early when a token names a kid we
+// have not seen (key rotation). One fetch at a time, in the background: callers keep using the
+// cached keys meanwhile, only those with nothing cached or an unknown kid wait for it.
+type jwks_cache struct {
+	url     string
+	ttl     time.Duration
+	client  *http.Client
+	mu      sync.Mutex
+	keys    []verification_key
+	fetched time.Time
+	tried   time.Time
+	rotated time.Time     // Last fetch for an unknown kid
+	pending chan struct{} // Closed when the fetch in flight is done, nil when there is none
+	failed  error         // How the last fetch went
+}
+
+// Fetches are never closer than jwks_min_refresh, and those for unknown kids never closer than
+// jwks_unknown_kid_refresh, so tokens with made up kids can't keep the endpoint busy
+const (
+	jwks_min_refresh         = 10 * time.Second
+	jwks_unknown_kid_refresh = time.Minute
+)
+
+// err_auth_unavailable when there are no keys because the endpoint can't be reached
+func (jc *jwks_cache) get(kid string) ([]verification_key, error) {
+	jc.mu.Lock()
+	now := time.Now()
+	stale := now.Sub(jc.fetched) > jc.ttl
+	unknown := kid != "" && !slices.ContainsFunc(jc.keys, func(k verification_key) bool { return k.kid == kid })
+	if jc.pending == nil && now.Sub(jc.tried) > jwks_min_refresh {
+		if stale || (unknown && now.Sub(jc.rotated) > jwks_unknown_kid_refresh) {
+			if !stale {
+				jc.rotated = now
+			}
+			jc.tried = now
+			jc.pending = make(chan struct{})
+			go jc.refresh(jc.pending)
+		}
+	}
+	pending, keys, err := jc.pending, jc.keys, jc.failed
+	jc.mu.Unlock()
+
+	if pending != nil && (len(keys) == 0 || unknown) {
+		<-pending
+		jc.mu.Lock()
+		keys, err = jc.keys, jc.failed
+		jc.mu.Unlock()
+	}
+	if len(keys) == 0 && err != nil {
+		return nil, fmt.Errorf("JWKS: %w: %w", err_auth_unavailable, err)
+	}
+	return keys, nil
+}
+
+// One fetch, started by get with the lock released
+func (jc *jwks_cache) refresh(done chan struct{}) {
+	keys, err := jc.fetch()
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+	if err != nil {
+		log.Printf("[WARNING] Fetching JWKS from %s failed, keeping %d cached keys: %v", jc.url, len(jc.keys), err)
+	} else {
+		jc.keys = keys
+		jc.fetched = time.Now()
+	}
+	jc.failed = err
+	jc.pending = nil
+	close(done)
+}
+
+func (jc *jwks_cache) fetch() ([]verification_key, error) {
+	resp, err := jc.client.Get(jc.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parse_jwks(data)
+}
+
+// Validates bearer tokens against a shared secret, a JWKS file or a JWKS URL
+type jwt_authenticator struct {
+	settings   authenticator_config
+	static     []verification_key // Secret or JWKS file
+	jwks       *jwks_cache        // JWKS URL, nil otherwise
+	algorithms []string
+}
+
+func new_jwt_authenticator(ac authenticator_config) (*jwt_authenticator, error) {
+	ja := &jwt_authenticator{settings: ac, algorithms: ac.Algorithms}
+	sources := 0
+	if ac.Secret != "" {
+		sources++
+		ja.static = []verification_key{{key: []byte(ac.Secret)}}
+	}
+	if ac.JWKSFile != "" {
+		sources++
+		data, err := os.ReadFile(ac.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if ja.static, err = parse_jwks(data); err != nil {
+			return nil, err
+		}
+	}
+	if ac.JWKSURL != "" {
+		sources++
+		ttl := time.Duration(ac.JWKSCacheTTL)
+		if ttl <= 0 {
+			ttl = 5 * time.Minute
+		}
+		ja.jwks = &jwks_cache{url: ac.JWKSURL, ttl: ttl, client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	if sources != 1 {
+		return nil, errors.New("jwt needs exactly one of secret, jwks_file or jwks_url")
+	}
+	if len(ja.algorithms) == 0 {
+		ja.algorithms = []string{"RS256", "ES256"}
+		if ac.Secret != "" {
+			ja.algorithms = []string{"HS256"}
+		}
+	}
+	for _, alg := range ja.algorithms {
+		if _, ok := jwt_hashes[alg]; !ok {
+			return nil, fmt.Errorf("unsupported algorithm %q", alg)
+		}
+	}
+	return ja, nil
+}
+
+func bearer_token(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func (ja *jwt_authenticator) authenticate(r *http.Request) (*consumer, error) {
+	token := bearer_token(r)
+	if token == "" {
+		return nil, err_no_credentials
+	}
+	claims, err := ja.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	claim := ja.settings.ConsumerClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	id, _ := claims[claim].(string)
+	if id == "" {
+		return nil, fmt.Errorf("token has no %s claim", claim)
+	}
+	return &consumer{ID: id, Claims: claims}, nil
+}
+
+func (ja *jwt_authenticator) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwt_header
+	raw_header, err := b64(parts[0])
+	if err != nil || json.Unmarshal(raw_header, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if !slices.Contains(ja.algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm %q not allowed", header.Alg)
+	}
+	signature, err := b64(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	keys := ja.static
+	if ja.jwks != nil {
+		if keys, err = ja.jwks.get(header.Kid); err != nil {
+			return nil, err
+		}
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verify_signature(header.Alg, k.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("bad signature")
+	}
+
+	claims := map[string]any{}
+	raw_claims, err := b64(parts[1])
+	if err != nil || json.Unmarshal(raw_claims, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return claims, ja.check_claims(claims, now)
+}
+
+func verify_signature(alg string, key any, signed, signature []byte) bool {
+	hash := jwt_hashes[alg]
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash_func(hash), secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := hash.New()
+		digest.Write(signed)
+		return rsa.VerifyPKCS1v15(public, hash, digest.Sum(nil), signature) == nil
+	case "ES":
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		// JWS signatures are r and s back to back, each padded to the curve size
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		digest := hash.New()
+		digest.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest.Sum(nil), r, s)
+	}
+	return false
+}
+
+func hash_func(h crypto.Hash) func() hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// exp and nbf with some leeway for clock skew, then iss and aud when configured
+func (ja *jwt_authenticator) check_claims(claims map[string]any, now time.Time) error {
+	leeway := time.Duration(ja.settings.Leeway)
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+			return errors.New("token expired")
+		}
+	} else if ja.settings.RequireExp {
+		return errors.New("token has no exp claim")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if ja.settings.Issuer != "" && claims["iss"] != ja.settings.Issuer {
+		return errors.New("wrong issuer")
+	}
+	if ja.settings.Audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == ja.settings.Audience {
+				return nil
+			}
+		case []any:
+			if slices.Contains(aud, any(ja.settings.Audience)) {
+				return nil
+			}
+		}
+		return errors.New("wrong audience")
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	test_now    = time.Unix(1_700_000_000, 0)
+	test_secret = []byte("a-shared-secret-of-some-length")
+	test_rsa, _ = rsa.GenerateKey(rand.Reader, 2048)
+	test_ec, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func segment(v any) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Signs claims with alg. key is []byte for HS, *rsa.PrivateKey for RS and *ecdsa.PrivateKey for ES.
+func sign_token(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	signed := segment(jwt_header{Alg: alg, Kid: kid}) + "." + segment(claims)
+	hash := jwt_hashes[alg]
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash_func(hash), k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	default:
+		t.Fatalf("no signer for %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func valid_claims() map[string]any {
+	return map[string]any{"sub": "alice", "exp": float64(test_now.Add(time.Hour).Unix())}
+}
+
+func TestJWTSignatures(t *testing.T) {
+	other_rsa, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other_ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsa_bytes := test_rsa.PublicKey.N.Bytes() // What an attacker would use as an HMAC secret
+
+	keys := []verification_key{
+		{kid: "hmac", key: test_secret},
+		{kid: "rsa", key: &test_rsa.PublicKey},
+		{kid: "ec", key: &test_ec.PublicKey},
+	}
+	tests := []struct {
+		name       string
+		algorithms []string
+		token      func(t *testing.T) string
+		want       string // Error text, empty when the token is good
+	}{
+		{"HS256", []string{"HS256"}, func(t *testing.T) string { return sign_token(t, "HS256", "hmac", test_secret, valid_claims()) }, ""},
+		{"HS512", []string{"HS512"}, func(t *testing.T) string { return sign_token(t, "HS512", "", test_secret, valid_claims()) }, ""},
+		{"RS256", []string{"RS256"}, func(t *testing.T) string { return sign_token(t, "RS256", "rsa", test_rsa, valid_claims()) }, ""},
+		{"RS384 without kid", []string{"RS384"}, func(t *testing.T) string { return sign_token(t, "RS384", "", test_rsa, valid_claims()) }, ""},
+		{"ES256", []string{"ES256"}, func(t *testing.T) string { return sign_token(t, "ES256", "ec", test_ec, valid_claims()) }, ""},
+		{"HS256 wrong secret", []string{"HS256"}, func(t *testing.T) string {
+			return sign_token(t, "HS256", "hmac", []byte("not-the-shared-secret"), valid_claims())
+		}, "bad signature"},
+		{"RS256 other key", []string{"RS256"}, func(t *testing.T) string { return sign_token(t, "RS256", "rsa", other_rsa, valid_claims()) }, "bad signature"},
+		{"ES256 other key", []string{"ES256"}, func(t *testing.T) string { return sign_token(t, "ES256", "ec", other_ec, valid_claims()) }, "bad signature"},
+		{"kid names another key", []string{"RS256"}, func(t *testing.T) string { return sign_token(t, "RS256", "ec", test_rsa, valid_claims()) }, "bad signature"},
+		{"alg not allowed", []string{"RS256"}, func(t *testing.T) string { return sign_token(t, "HS256", "hmac", test_secret, valid_claims()) }, `algorithm "HS256" not allowed`},
+		{"alg none", []string{"RS256", "HS256"}, func(t *testing.T) string {
+			return segment(map[string]string{"alg": "none"}) + "." + segment(valid_claims()) + "."
+		}, `algorithm "none" not allowed`},
+		{"HS256 signed with the RSA public key", []string{"RS256", "HS256"}, func(t *testing.T) string {
+			return sign_token(t, "HS256", "rsa", rsa_bytes, valid_claims())
+		}, "bad signature"},
+		{"ES256 signature under RS256", []string{"RS256", "ES256"}, func(t *testing.T) string {
+			token := sign_token(t, "ES256", "ec", test_ec, valid_claims())
+			parts := strings.Split(token, ".")
+			return segment(jwt_header{Alg: "RS256", Kid: "ec"}) + "." + parts[1] + "." + parts[2]
+		}, "bad signature"},
+		{"claims changed after signing", []string{"HS256"}, func(t *testing.T) string {
+			token := sign_token(t, "HS256", "hmac", test_secret, valid_claims())
+			parts := strings.Split(token, ".")
+			claims := valid_claims()
+			claims["sub"] = "mallory"
+			return parts[0] + "." + segment(claims) + "." + parts[2]
+		}, "bad signature"},
+		{"two parts", []string{"HS256"}, func(t *testing.T) string { return "abc.def" }, "malformed token"},
+		{"header not JSON", []string{"HS256"}, func(t *testing.T) string { return "bm90IGpzb24.e30.c2ln" }, "malformed token header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := &jwt_authenticator{static: keys, algorithms: tt.algorithms}
+			claims, err := ja.verify(tt.token(t), test_now)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("verify failed: %v", err)
+			case tt.want == "" && claims["sub"] != "alice":
+				t.Fatalf("got claims %v", claims)
+			case tt.want != "" && (err == nil || err.Error() != tt.want):
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	hour := float64(time.Hour / time.Second)
+	now := float64(test_now.Unix())
+	tests := []struct {
+		name     string
+		settings authenticator_config
+		claims   map[string]any
+		want     string
+	}{
+		{"no exp", authenticator_config{}, map[string]any{}, ""},
+		{"no exp but required", authenticator_config{RequireExp: true}, map[string]any{}, "token has no exp claim"},
+		{"expired", authenticator_config{}, map[string]any{"exp": now - 1}, "token expired"},
+		{"expired within leeway", authenticator_config{Leeway: duration(time.Minute)}, map[string]any{"exp": now - 30}, ""},
+		{"expired past leeway", authenticator_config{Leeway: duration(time.Minute)}, map[string]any{"exp": now - 61}, "token expired"},
+		{"expires right now", authenticator_config{}, map[string]any{"exp": now}, ""},
+		{"not valid yet", authenticator_config{}, map[string]any{"nbf": now + 1}, "token not valid yet"},
+		{"nbf within leeway", authenticator_config{Leeway: duration(time.Minute)}, map[string]any{"nbf": now + 30}, ""},
+		{"nbf in the past", authenticator_config{}, map[string]any{"nbf": now - hour, "exp": now + hour}, ""},
+		{"issuer matches", authenticator_config{Issuer: "https://idp"}, map[string]any{"iss": "https://idp"}, ""},
+		{"wrong issuer", authenticator_config{Issuer: "https://idp"}, map[string]any{"iss": "https://evil"}, "wrong issuer"},
+		{"missing issuer", authenticator_config{Issuer: "https://idp"}, map[string]any{}, "wrong issuer"},
+		{"audience string", authenticator_config{Audience: "gateway"}, map[string]any{"aud": "gateway"}, ""},
+		{"audience array", authenticator_config{Audience: "gateway"}, map[string]any{"aud": []any{"other", "gateway"}}, ""},
+		{"wrong audience", authenticator_config{Audience: "gateway"}, map[string]any{"aud": "other"}, "wrong audience"},
+		{"audience array without us", authenticator_config{Audience: "gateway"}, map[string]any{"aud": []any{"other"}}, "wrong audience"},
+		{"missing audience", authenticator_config{Audience: "gateway"}, map[string]any{}, "wrong audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := &jwt_authenticator{settings: tt.settings}
+			err := ja.check_claims(tt.claims, test_now)
+			if tt.want == "" && err != nil {
+				t.Fatalf("check_claims failed: %v", err)
+			}
+			if tt.want != "" && (err == nil || err.Error() != tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// A well signed token still goes through the claim checks
+func TestJWTVerifyChecksClaims(t *testing.T) {
+	ja := &jwt_authenticator{static: []verification_key{{key: test_secret}}, algorithms: []string{"HS256"}}
+	claims := valid_claims()
+	claims["exp"] = float64(test_now.Add(-time.Hour).Unix())
+	if _, err := ja.verify(sign_token(t, "HS256", "", test_secret, claims), test_now); err == nil || err.Error() != "token expired" {
+		t.Fatalf("got error %v, want token expired", err)
+	}
+}
+
+func TestJWKSKeyTypes(t *testing.T) {
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": base64.RawURLEncoding.EncodeToString(test_rsa.PublicKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64.RawURLEncoding.EncodeToString(test_ec.PublicKey.X.Bytes()), "y": base64.RawURLEncoding.EncodeToString(test_ec.PublicKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(jwks)
+	keys, err := parse_jwks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want the two signing keys", len(keys))
+	}
+	ja := &jwt_authenticator{static: keys, algorithms: []string{"RS256", "ES256", "HS256"}}
+	for _, token := range []string{
+		sign_token(t, "RS256", "rsa", test_rsa, valid_claims()),
+		sign_token(t, "ES256", "ec", test_ec, valid_claims()),
+	} {
+		if _, err := ja.verify(token, test_now); err != nil {
+			t.Errorf("verify failed: %v", err)
+		}
+	}
+	// The RSA modulus as an HMAC secret must not verify against a JWKS that only has public keys
+	confused := sign_token(t, "HS256", "rsa", test_rsa.PublicKey.N.Bytes(), valid_claims())
+	if _, err := ja.verify(confused, test_now); err == nil {
+		t.Fatal("HS256 token verified against an RSA key")
+	}
+	if _, err := parse_jwks([]byte(`{"keys":[{"kty":"EC","crv":"P-999","x":"AA","y":"AA"}]}`)); err == nil {
+		t.Fatal("unknown curve accepted")
+	}
+}
+
+func TestVerifySignatureKeyMismatch(t *testing.T) {
+	signed := []byte("header.claims")
+	mac := hmac.New(sha256.New, test_secret)
+	mac.Write(signed)
+	hs := mac.Sum(nil)
+	tests := []struct {
+		alg string
+		key any
+	}{
+		{"HS256", &test_rsa.PublicKey},
+		{"HS256", &test_ec.PublicKey},
+		{"RS256", test_secret},
+		{"RS256", &test_ec.PublicKey},
+		{"ES256", test_secret},
+		{"ES256", &test_rsa.PublicKey},
+	}
+	for _, tt := range tests {
+		if verify_signature(tt.alg, tt.key, signed, hs) {
+			t.Errorf("%s verified with a %T", tt.alg, tt.key)
+		}
+	}
+	if !verify_signature("HS256", test_secret, signed, hs) {
+		t.Error("HS256 did not verify with the right secret")
+	}
+	// JWS wants r and s padded to the curve size, anything shorter is rejected
+	if verify_signature("ES256", &test_ec.PublicKey, signed, make([]byte, 63)) {
+		t.Error("short ES256 signature verified")
+	}
+}
+
+func TestPasswordMatches(t *testing.T) {
+	sum := sha256.Sum256([]byte("hunter2"))
+	hashed := "sha256:" + hex.EncodeToString(sum[:])
+	tests := []struct {
+		stored, password string
+		want             bool
+	}{
+		{"hunter2", "hunter2", true},
+		{"hunter2", "hunter3", false},
+		{"hunter2", "", false},
+		{"hunter2", "hunter22", false},
+		{hashed, "hunter2", true},
+		{strings.ToUpper(hashed[:7]) + strings.ToUpper(hashed[7:]), "hunter2", false}, // Prefix is case sensitive
+		{"sha256:" + strings.ToUpper(hex.EncodeToString(sum[:])), "hunter2", true},
+		{hashed, "hunter3", false},
+		{hashed, hashed, false}, // The stored hash is not a password
+		{"sha256:", "", false},
+	}
+	for _, tt := range tests {
+		if got := password_matches(tt.stored, tt.password); got != tt.want {
+			t.Errorf("password_matches(%q, %q) = %v, want %v", tt.stored, tt.password, got, tt.want)
+		}
+	}
+}
+
+// A JWKS endpoint serving the test RSA key under whichever kid is current. While gate is set,
+// every fetch waits for it to close.
+type fake_jwks struct {
+	mu    sync.Mutex
+	kid   string
+	fails bool
+	gate  chan struct{}
+	calls atomic.Int32
+}
+
+func (fj *fake_jwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fj.calls.Add(1)
+	fj.mu.Lock()
+	kid, fails, gate := fj.kid, fj.fails, fj.gate
+	fj.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	if fails {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": kid, "n": base64.RawURLEncoding.EncodeToString(test_rsa.PublicKey.N.Bytes()), "e": "AQAB"},
+	}})
+}
+
+// Calls get, failing the test when it blocks
+func get_quickly(t *testing.T, jc *jwks_cache, kid string) ([]verification_key, error) {
+	t.Helper()
+	type answer struct {
+		keys []verification_key
+		err  error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		keys, err := jc.get(kid)
+		done <- answer{keys, err}
+	}()
+	select {
+	case a := <-done:
+		return a.keys, a.err
+	case <-time.After(2 * time.Second):
+		t.Fatalf("get(%q) blocked", kid)
+		return nil, nil
+	}
+}
+
+// Waits for the fetch in flight, if any
+func settle(jc *jwks_cache) {
+	jc.mu.Lock()
+	pending := jc.pending
+	jc.mu.Unlock()
+	if pending != nil {
+		<-pending
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	// Make the cache look like its last fetch was long ago
+	age := func(jc *jwks_cache) {
+		jc.mu.Lock()
+		jc.fetched = jc.fetched.Add(-time.Hour)
+		jc.tried = jc.tried.Add(-time.Hour)
+		jc.mu.Unlock()
+	}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, fj *fake_jwks, jc *jwks_cache)
+	}{
+		{"first fetch is waited for", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			keys, err := get_quickly(t, jc, "k1")
+			if err != nil || len(keys) != 1 || keys[0].kid != "k1" {
+				t.Fatalf("got %v, %v", keys, err)
+			}
+		}},
+		{"stale keys are served while the refresh runs", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			get_quickly(t, jc, "k1")
+			age(jc)
+			gate := make(chan struct{})
+			fj.mu.Lock()
+			fj.gate = gate
+			fj.mu.Unlock()
+			for range 5 {
+				if keys, err := get_quickly(t, jc, "k1"); err != nil || len(keys) != 1 {
+					t.Fatalf("got %v, %v", keys, err)
+				}
+			}
+			close(gate)
+			settle(jc)
+			if fj.calls.Load() != 2 {
+				t.Fatalf("%d fetches, want one refresh for all of them", fj.calls.Load())
+			}
+		}},
+		{"rotated key is fetched for its kid", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			get_quickly(t, jc, "k1")
+			age(jc)
+			jc.fetched = time.Now() // Fresh, only the kid is new
+			fj.mu.Lock()
+			fj.kid = "k2"
+			fj.mu.Unlock()
+			keys, err := get_quickly(t, jc, "k2")
+			if err != nil || len(keys) != 1 || keys[0].kid != "k2" {
+				t.Fatalf("got %v, %v", keys, err)
+			}
+		}},
+		{"made up kids don't each cause a fetch", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			get_quickly(t, jc, "k1")
+			age(jc)
+			jc.fetched = time.Now()
+			for i := range 20 {
+				get_quickly(t, jc, fmt.Sprintf("random-%d", i))
+			}
+			// Past jwks_min_refresh but not jwks_unknown_kid_refresh
+			jc.tried = time.Now().Add(-2 * jwks_min_refresh)
+			get_quickly(t, jc, "random-again")
+			if fj.calls.Load() != 2 {
+				t.Fatalf("%d fetches, want one for the first unknown kid only", fj.calls.Load())
+			}
+		}},
+		{"endpoint down with nothing cached", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			fj.fails = true
+			if _, err := get_quickly(t, jc, "k1"); !errors.Is(err, err_auth_unavailable) {
+				t.Fatalf("got error %v, want err_auth_unavailable", err)
+			}
+		}},
+		{"endpoint down with keys cached", func(t *testing.T, fj *fake_jwks, jc *jwks_cache) {
+			get_quickly(t, jc, "k1")
+			age(jc)
+			fj.mu.Lock()
+			fj.fails = true
+			fj.mu.Unlock()
+			get_quickly(t, jc, "k1") // Starts the refresh that fails
+			settle(jc)
+			if keys, err := get_quickly(t, jc, "k1"); err != nil || len(keys) != 1 {
+				t.Fatalf("got %v, %v, want the cached key", keys, err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fj := &fake_jwks{kid: "k1"}
+			endpoint := httptest.NewServer(fj)
+			defer endpoint.Close()
+			jc := &jwks_cache{url: endpoint.URL, ttl: time.Minute, client: endpoint.Client()}
+			tt.run(t, fj, jc)
+			settle(jc)
+		})
+	}
+}
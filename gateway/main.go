@@ -1,164 +1,54 @@
 package main
 
 import (
-	"bytes"
-	"container/heap"
-	"container/list"
 	"context"
 	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 )
 
-var rate_limiting_cache = make(map[string]*list.List)
-var rate_limiting_mutex sync.Mutex
-var server_heap_mutex sync.Mutex
-
 type registered_server struct {
 	URL string `json:"url"`
 	Port string `json:"port"`
+	Service string `json:"service"`	// Pool to join, empty means the default pool
+	Weight int `json:"weight"`	// Relative share of the pool's traffic, 1 when left out
+	Zone string `json:"zone"`
+	Version string `json:"version"`
+	Tags []string `json:"tags"`
 }
 
+const max_server_weight = 100	// Ring hash puts weight * 100 points per server on the ring
+
 func loggingMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         start := time.Now()
 
-        log.Printf("[%s] %s %s\n", start.Format("15:04"), r.Method, r.URL.Path)
+        log.Printf("[%s] %s %s %s\n", start.Format("15:04"), request_id(r.Context()), r.Method, r.URL.Path)
 
         next.ServeHTTP(w, r) // Call the actual handler
 
-		log.Printf("[%s] %s %s Done\n", start.Format("15:04"), r.Method, r.URL.Path)
+		log.Printf("[%s] %s %s %s Done (consumer %s)\n", start.Format("15:04"), request_id(r.Context()), r.Method, r.URL.Path, request_consumer(r.Context()))
     })
 }
 
-func rate_limiter(request *http.Request) bool {
-	client_ip, _, err := net.SplitHostPort(request.RemoteAddr)
-	if err != nil {
-		// RemoteAddr might already be just an IP (rare), so fall back:
-		client_ip = request.RemoteAddr
-	}
-	var client_time = time.Now()
-	rate_limiting_mutex.Lock()
-	defer rate_limiting_mutex.Unlock()
-	value, exists := rate_limiting_cache[client_ip]
-	if !exists {
-		new_list := list.New()
-		rate_limiting_cache[client_ip] = new_list
-		new_list.PushBack(client_time)
-	} else{
-		// Clean up old queries beyond time window
-		current_time := time.Now()
-		for {
-			oldest := value.Front()
-			if oldest == nil{	// list is empty
-				break
-			}
-			oldest_time := oldest.Value.(time.Time) 
-			//its type is interface{}, so Go doesn’t know it’s a time.Time — you must assert that manually
-			difference := current_time.Sub(oldest_time).Seconds()
-			if difference > 0.5 {
-				value.Remove(oldest)
-			} else{
-				break
-			}
-		}
-		value.PushBack(client_time)
-		if value.Len() >= 35{
-			return false
-		}
-	}
-	return true
-}
-
-
-func echoHandler(initial_response http.ResponseWriter, initial_request *http.Request) {
-	safetogo := rate_limiter(initial_request)
-	if !safetogo{
-		http.Error(initial_response, "Too many requests", http.StatusTooManyRequests)
-		return
-	}
-
-	body, err := io.ReadAll(initial_request.Body)	//body is of type bytes
-	if err != nil{
-		http.Error(initial_response, "Failed to read the body", http.StatusBadRequest)
-		return
-	}
-	defer initial_request.Body.Close()
-
-	// Calls a function that returns which endpoints are available to use. 
-	// BTS it keeps checking and updating the available endpoints
-	if len(sh) == 0 {
-		http.Error(initial_response, "No upstream servers available", http.StatusServiceUnavailable)
-		return
-	}
-	server := sh[0]
-	url := server.URL+"/echo"
-	server.mu.Lock()
-	server.in_queue ++
-	server_heap_mutex.Lock()
-	heap.Fix(&sh, server.index)
-	server_heap_mutex.Unlock()
-	server.mu.Unlock()
-	
-	// Adding outbound actions for tracing
-	log.Printf("Gateway making a Post call to %s", url)
-	ctx := initial_request.Context()
-	tr := otel.Tracer("gateway")
-	ctx, span := tr.Start(ctx, "forward_to_app_server")
-	defer span.End()
-
-	// response, err := http.Post(url, "text/plain", bytes.NewBuffer(body))	// bytes not allowed, need io.Reader
-	client := http.Client{
-		Transport: otelhttp.NewTransport(http.DefaultTransport),	// Injects trace headers
-	}
-	req,err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
-	if err != nil{
-		http.Error(initial_response, err.Error(), http.StatusBadGateway)
-		return
-	} 
-	req.Header.Set("Content-Type", "text/plain")
-	
-	response, err := client.Do(req)	// Actually making an API call. Call details stored in req
-	if err != nil{
-		http.Error(initial_response, err.Error(), http.StatusBadGateway)
-		return
-	} 
-	defer response.Body.Close()
-
-
-	log.Println("Response status: ", response.Status)
-	
-	if response.StatusCode != http.StatusOK {
-		http.Error(initial_response, "Upstream server error", http.StatusBadGateway)
-		return
-	}
-	responseBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		http.Error(initial_response, "Failed to read body from upstream", http.StatusBadGateway)
-		return
-	}
-
-	// Send API response back to the client from mock server
-	initial_response.Header().Set("Content-Type", "text/plain")	// The output is going to be of text type
-	initial_response.WriteHeader(http.StatusOK)
-	fmt.Fprint(initial_response, string(responseBody))
-	server.mu.Lock()
-	server.in_queue -= 1
-	server.mu.Unlock()
-}
-
 func registerServer(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost{
 		http.Error(w, "Did not use the right method. Use Post", http.StatusBadRequest)
 		return
 	}
+	caller, ok := control_identity(w, req)
+	if !ok {
+		return
+	}
 	var server registered_server
     err := json.NewDecoder(req.Body).Decode(&server)
 	if err != nil {
@@ -169,28 +59,44 @@ func registerServer(w http.ResponseWriter, req *http.Request) {
 
 	url = server.URL
 	port = server.Port
+	entry := audit_entry{Server: port, URL: url, Pool: server.Service}
 	if err != nil{
 		log.Println("Errored out during reading of port.")
+		entry.Outcome, entry.Reason = "rejected", "bad JSON"
+		audit(req, caller, entry)
 		return
 	}
 
-	_,exists := servers[port]
-	if exists{
-		http.Error(w, "Server already added", http.StatusConflict)
+	if server.Weight < 0 || server.Weight > max_server_weight{
+		http.Error(w, fmt.Sprintf("Weight must be between 1 and %d, or 0 for the default of 1", max_server_weight), http.StatusBadRequest)
+		entry.Outcome, entry.Reason = "rejected", "bad weight"
+		audit(req, caller, entry)
 		return
 	}
 
-	servers[port] = &server_struct{
+	pool := get_pool(server.Service)
+	added := add_unique(pool, &server_struct{
 		URL: url,
 		alive: true,
 		last_updated: time.Now().Unix(),
 		port: port,
+		owner: caller.identity,
+		weight: max(server.Weight, 1),
+		zone: server.Zone,
+		version: server.Version,
+		tags: server.Tags,
+	})
+	entry.Pool = pool.name
+	if !added{
+		http.Error(w, "Server already added", http.StatusConflict)
+		entry.Outcome, entry.Reason = "rejected", "already added"
+		audit(req, caller, entry)
+		return
 	}
-	server_heap_mutex.Lock()
-	heap.Push(&sh, servers[port])	// Add to heap as well
-	server_heap_mutex.Unlock()
+	entry.Outcome = "ok"
+	audit(req, caller, entry)
 
-	log.Printf("Server URL : %s port: %s connected successfully", url, port)
+	log.Printf("Server URL : %s port: %s weight: %d connected successfully to pool %s", url, port, max(server.Weight, 1), pool.name)
 	w.WriteHeader(http.StatusOK)	// Sends the status code back to client
 	fmt.Fprintf(w, "Server %s connected successfully", req.RemoteAddr)
 }
@@ -200,6 +106,10 @@ func exitServer(w http.ResponseWriter, req *http.Request){
 		http.Error(w, "Need to use POST call for /exit", http.StatusBadRequest)
 		return
 	}
+	caller, ok := control_identity(w, req)
+	if !ok {
+		return
+	}
 
 	body, err := io.ReadAll(req.Body)	//body is of type bytes
 	if err != nil{
@@ -207,13 +117,25 @@ func exitServer(w http.ResponseWriter, req *http.Request){
 		return
 	}
 
-	server, exists := servers[string(body)]	// TODO Fails here. Searching based on port but key is UID
-	if !exists || !remove_server(server) {
+	server := find_server(string(body))
+	entry := audit_entry{Server: string(body)}
+	if server != nil && server.owner != "" && server.owner != caller.identity {
+		http.Error(w, "Server was registered by someone else", http.StatusForbidden)
+		log.Printf("[WARNING] %q tried to remove server %s owned by %q", caller.identity, server.port, server.owner)
+		entry.Outcome, entry.Reason = "denied", "owned by "+server.owner
+		audit(req, caller, entry)
+		return
+	}
+	if server == nil || !remove_server(server) {
+		entry.Outcome, entry.Reason = "rejected", "not found"
+		audit(req, caller, entry)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Server %s could not be found", string(body))
 		log.Printf("Server %s could not be found", string(body))
 		return
 	}
+	entry.URL, entry.Outcome = server.URL, "ok"
+	audit(req, caller, entry)
 	log.Printf("Removed server with port %s", string(body))
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Removed server with port %s", string(body))
@@ -222,9 +144,16 @@ func exitServer(w http.ResponseWriter, req *http.Request){
 func main() {
 	log.SetFlags(log.Ltime | log.Lshortfile)
 	log.Println("This is the gateway module")
+	flag.Parse()
+
+	err := load_config()
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+	go watch_config()	// Picks up SIGHUP and edits to the config file
 
 	// Open telemetry
-	tp, err := initTracer("api_gateway")
+	tp, err := initTracer("api_gateway", cfg().Telemetry.Endpoint)
 	if err != nil {
 		log.Fatalln("Could not start open telemetry")
 	}
@@ -232,34 +161,123 @@ func main() {
 	
 	// This creates a root span
 	mux := http.NewServeMux()
-    mux.Handle("/echo", 
+    mux.Handle("/", 
 		otelhttp.NewHandler(
-			http.HandlerFunc(echoHandler),
-			"echo-gateway-handler",
+			authMiddleware(http.HandlerFunc(proxyHandler)),	// Authentication and route scopes, see auth.go
+			"proxy-gateway-handler",
 		),
-	)	// Function that runs when endpoint is reached
+	)	// Anything that is not a gateway endpoint gets forwarded upstream
 
-	mux.Handle("/registerServer", 
+	// Registration, admin and metrics endpoints, on their own listener when control.listener is set
+	control := http.NewServeMux()
+	control.Handle("/registerServer", 
 		otelhttp.NewHandler(
 			http.HandlerFunc(registerServer),
 			"register-server",
 		),
 	)
 
-	mux.Handle("/exit", 
+	control.Handle("/exit", 
 		otelhttp.NewHandler(
 			http.HandlerFunc(exitServer),
 			"exit-server",
 		),
 	)
 
-	heap.Init(&sh)
-	
-	wrapped := otelhttp.NewHandler(loggingMiddleware(mux), "gateway-root")
+	control.Handle("/admin/upstreams", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(upstreamsHandler),
+			"admin-upstreams",
+		),
+	)
+
+	control.Handle("/admin/ratelimits", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(rateLimitsHandler),
+			"admin-ratelimits",
+		),
+	)
+
+	control.Handle("/admin/pools", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(poolsHandler),
+			"admin-pools",
+		),
+	)
+
+	control.Handle("/admin/circuits", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(circuitsHandler),
+			"admin-circuits",
+		),
+	)
+
+	control.Handle("/admin/consumers", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(consumersHandler),
+			"admin-consumers",
+		),
+	)
+
+	control.Handle("/admin/consumers/", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(consumerHandler),
+			"admin-consumer",
+		),
+	)
+
+	control.Handle("/admin/bans", 
+		otelhttp.NewHandler(
+			http.HandlerFunc(bansHandler),
+			"admin-bans",
+		),
+	)
+
+	control.Handle("/debug/vars", controlReadHandler(expvar.Handler()))	// Metrics, see metrics.go
+
+	control_listener := cfg().Control.Listener
+	cfg().Control.warn_unauthenticated()
+	if control_listener == nil {
+		log.Println("[WARNING] No control.listener, the control endpoints share the public listeners")
+		paths := []string{"/registerServer", "/exit"}
+		if cfg().Control.authenticated() {
+			paths = append(paths, "/admin/", "/debug/vars")
+		} else {
+			log.Println("[WARNING] /admin/ and /debug/vars are off, they need control.listener or control credentials")
+		}
+		for _, path := range paths {
+			mux.Handle(path, publicControlMiddleware(control))
+		}
+	}
+
+	wrapped := otelhttp.NewHandler(requestIDMiddleware(loggingMiddleware(mux)), "gateway-root")
 	go start_heartbeat()	// Start heartbeat service in the background
-	log.Println("Server starting on port 8080")
-	err = http.ListenAndServe(":8080", wrapped) // blocked until done
-	if err != nil {
-		log.Println("There was an error starting the server", err)
+
+	// One goroutine per listener, main waits until any of them dies
+	listeners := cfg().Listeners
+	failed := make(chan error, len(listeners)+1)	// Room for the control listener too
+	for _, l := range listeners {
+		go func(l listener_config) {
+			log.Printf("Server starting on %s", l.Addr)
+			failed <- serve_listener(l, wrapped, cfg().Server) // blocked until done
+		}(l)
+	}
+	if control_listener != nil {
+		control_wrapped := otelhttp.NewHandler(requestIDMiddleware(loggingMiddleware(control)), "gateway-control")
+		go func() {
+			log.Printf("Control endpoints on %s", control_listener.Addr)
+			failed <- serve_listener(*control_listener, control_wrapped, cfg().Server)
+		}()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-failed:
+		if err != nil {
+			log.Println("There was an error starting the server", err)
+		}
+	case sig := <-stop:
+		log.Printf("Got %s, shutting down", sig)
 	}
+	save_consumers()	// Returning lets the deferred tracer shutdown flush the spans
 }
\ No newline at end of file
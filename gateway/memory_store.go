@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Independent locks so clients hashing to different shards never wait on each other
+const memory_shards = 64
+
+// Single process store, also the stand-in when there is no Redis around. Memory is bounded:
+// each shard keeps an LRU list and drops its least recently seen key when full, and a sweeper
+// removes keys that went quiet for longer than idle_ttl. Every operation is O(1).
+type memory_store struct {
+	shards   [memory_shards]memory_shard
+	idle_ttl time.Duration
+	done     chan struct{}
+}
+
+type memory_shard struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // Front is the most recently used
+	capacity int
+}
+
+type memory_entry struct {
+	key       string
+	state     bucket
+	last_seen time.Time
+}
+
+func new_memory_store(max_keys int, idle_ttl time.Duration) *memory_store {
+	m := &memory_store{idle_ttl: idle_ttl, done: make(chan struct{})}
+	for i := range m.shards {
+		m.shards[i] = memory_shard{
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+			capacity: max_keys / memory_shards,
+		}
+	}
+	go m.sweep()
+	return m
+}
+
+// FNV-1a without the allocation hash/fnv needs for a string
+func shard_index(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % memory_shards)
+}
+
+func (m *memory_store) take(ctx context.Context, key string, policy *rate_limit_policy, now time.Time) (rate_limit_result, error) {
+	shard := &m.shards[shard_index(key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	element, exists := shard.entries[key]
+	if exists && now.Sub(element.Value.(*memory_entry).last_seen) > m.idle_ttl {
+		// Expired but not swept yet, same as never seen
+		shard.lru.Remove(element)
+		delete(shard.entries, key)
+		exists = false
+	}
+	if !exists {
+		if shard.lru.Len() >= shard.capacity {
+			oldest := shard.lru.Back()
+			shard.lru.Remove(oldest)
+			delete(shard.entries, oldest.Value.(*memory_entry).key)
+		}
+		element = shard.lru.PushFront(&memory_entry{
+			key:   key,
+			state: bucket{tokens: float64(policy.burst()), last: now, window_start: now.Truncate(time.Duration(policy.Window))},
+		})
+		shard.entries[key] = element
+	} else {
+		shard.lru.MoveToFront(element)
+	}
+	entry := element.Value.(*memory_entry)
+	entry.last_seen = now
+	return entry.state.take(policy, now), nil
+}
+
+// Walks each LRU list from the cold end, so it only touches keys it actually removes
+func (m *memory_store) sweep() {
+	ticker := time.NewTicker(m.idle_ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			for i := range m.shards {
+				shard := &m.shards[i]
+				shard.mu.Lock()
+				for oldest := shard.lru.Back(); oldest != nil; oldest = shard.lru.Back() {
+					entry := oldest.Value.(*memory_entry)
+					if now.Sub(entry.last_seen) <= m.idle_ttl {
+						break
+					}
+					shard.lru.Remove(oldest)
+					delete(shard.entries, entry.key)
+				}
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Number of keys currently held, for the admin view
+func (m *memory_store) size() int {
+	total := 0
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+		total += m.shards[i].lru.Len()
+		m.shards[i].mu.Unlock()
+	}
+	return total
+}
+
+func (m *memory_store) close() { close(m.done) }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Throughput of the sharded store with many distinct clients hitting it at once, e.g.
+//
+//	go test ./gateway -run '^$' -bench MemoryStore -cpu 1,4,16
+func BenchmarkMemoryStoreTake(b *testing.B) {
+	for _, algorithm := range []string{token_bucket, fixed_window, sliding_window} {
+		for _, clients := range []int{10000, 100000} {
+			b.Run(fmt.Sprintf("%s/%d_clients", algorithm, clients), func(b *testing.B) {
+				bench_memory_store(b, algorithm, clients, clients)
+			})
+		}
+	}
+}
+
+// More clients than max_keys, so most takes evict the least recently seen key
+func BenchmarkMemoryStoreTakeEvicting(b *testing.B) {
+	bench_memory_store(b, sliding_window, 50000, 10000)
+}
+
+func bench_memory_store(b *testing.B, algorithm string, clients, max_keys int) {
+	store := new_memory_store(max_keys, time.Hour)
+	defer store.close()
+	policy := &rate_limit_policy{name: "bench", Algorithm: algorithm, Window: duration(time.Second), MaxRequests: 100, Key: []string{"ip"}}
+	keys := make([]string, clients)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench|10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+	ctx := context.Background()
+	start := time.Now()
+	var next atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine walks its own stretch of the clients so they don't all hit one shard
+		i := next.Add(7919) * 7919
+		for pb.Next() {
+			i++
+			key := keys[i%uint64(len(keys))]
+			if _, err := store.take(ctx, key, policy, start.Add(time.Duration(i)*time.Microsecond)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "expvar"
+
+// Counters served as JSON on /debug/vars, next to the runtime stats expvar adds on its own
+
+// Circuit transitions by the phase they went to
+var circuit_transitions = expvar.NewMap("circuit_transitions")
+
+// Requests refused by IP: banned, deny_list or allow_list
+var access_denied = expvar.NewMap("access_denied")
+
+// Clients banned for hitting the rate limit too often
+var ip_bans = expvar.NewInt("ip_bans")
+
+func init() {
+	// Circuit phase per server right now, keyed pool/port
+	expvar.Publish("circuit_state", expvar.Func(func() any {
+		states := make(map[string]string)
+		for _, p := range all_pools() {
+			for _, s := range p.members() {
+				s.mu.RLock()
+				phase := s.circuit.phase
+				s.mu.RUnlock()
+				states[p.name+"/"+s.port] = phase.String()
+			}
+		}
+		return states
+	}))
+}
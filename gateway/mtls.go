@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// How the gateway talks TLS to app servers registered with https:// URLs
+type upstream_tls_config struct {
+	CAFile   string `json:"ca_file"`   // Verifies app servers, the system roots when empty
+	CertFile string `json:"cert_file"` // Client certificate the gateway presents, for app servers that want mTLS
+	KeyFile  string `json:"key_file"`
+}
+
+func load_ca_pool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+func (uc upstream_tls_config) load() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if uc.CAFile != "" {
+		pool, err := load_ca_pool(uc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if (uc.CertFile == "") != (uc.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file go together")
+	}
+	if uc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(uc.CertFile, uc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// Loads the upstream TLS files once per config. validate reports the error.
+func (c *gateway_config) fill_upstream_tls() {
+	c.upstream_tls, c.upstream_tls_err = c.UpstreamTLS.load()
+}
+
+// Identity of a caller with a verified client certificate: its first URI SAN (SPIFFE style),
+// else its first DNS SAN, else its common name. Empty without a verified certificate.
+func cert_identity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	switch {
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	}
+	return leaf.Subject.CommonName
+}
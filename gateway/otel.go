@@ -18,12 +18,12 @@ import (
 	"time"
 )
 
-func initTracer(service_name string) (*sdktrace.TracerProvider, error) {
+func initTracer(service_name string, endpoint string) (*sdktrace.TracerProvider, error) {
 	ctx := context.Background()
 
-	// 1. Exporter sends the span to the Collector at port 4318
+	// 1. Exporter sends the span to the Collector (localhost:4318 unless the config says otherwise)
 	exporter, err := otlptracehttp.New(ctx,
-		otlptracehttp.WithEndpoint("localhost:4318"), // Connects to Collector not Jaeger
+		otlptracehttp.WithEndpoint(endpoint), // Connects to Collector not Jaeger
 		otlptracehttp.WithInsecure(), // Use http and not https
 	)
 	if err != nil {
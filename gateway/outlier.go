@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Passive health checking. Every proxied request reports back here and servers that keep
+// failing get ejected for a while, longer each time it happens (same idea as Envoy).
+type outlier_config struct {
+	ConsecutiveErrors  int      `json:"consecutive_errors"`   // Errors in a row that eject a server, 0 turns it off
+	ErrorRate          float64  `json:"error_rate"`           // Share of failed requests inside Window that ejects, 0 turns it off
+	MinRequests        int      `json:"min_requests"`         // Error rate is only judged after this many requests in the window
+	Window             duration `json:"window"`               // How long error rate counters live before starting over
+	BaseEjectionTime   duration `json:"base_ejection_time"`   // Ejection n lasts n * BaseEjectionTime
+	MaxEjectionTime    duration `json:"max_ejection_time"`    // Cap on the above
+	MaxEjectionPercent int      `json:"max_ejection_percent"` // Never eject more than this share of a pool
+}
+
+// Outlier state of one server, guarded by server_struct.mu
+type outlier_state struct {
+	consecutive_errors int
+	window_start       time.Time
+	window_requests    int
+	window_errors      int
+	ejected            bool
+	ejected_until      time.Time
+	ejections          int       // Drives the growing backoff
+	last_ejection      time.Time // Old ejections are forgiven after MaxEjectionTime without trouble
+}
+
+func (s *server_struct) is_ejected(now time.Time) bool {
+	return s.outlier.ejected && now.Before(s.outlier.ejected_until)
+}
+
+// Called once per upstream attempt with whether it worked
+func record_result(server *server_struct, ok bool) {
+	oc := cfg().OutlierDetection
+	now := time.Now()
+
+	server.mu.Lock()
+	o := &server.outlier
+	if now.Sub(o.window_start) > time.Duration(oc.Window) {
+		o.window_start = now
+		o.window_requests = 0
+		o.window_errors = 0
+	}
+	o.window_requests++
+	if ok {
+		o.consecutive_errors = 0
+		server.mu.Unlock()
+		return
+	}
+	o.consecutive_errors++
+	o.window_errors++
+
+	reason := ""
+	if oc.ConsecutiveErrors > 0 && o.consecutive_errors >= oc.ConsecutiveErrors {
+		reason = "consecutive errors"
+	} else if oc.ErrorRate > 0 && o.window_requests >= oc.MinRequests &&
+		float64(o.window_errors)/float64(o.window_requests) >= oc.ErrorRate {
+		reason = "error rate"
+	}
+	already_ejected := server.is_ejected(now)
+	server.mu.Unlock()
+
+	if reason == "" || already_ejected || !can_eject(server) {
+		return
+	}
+	eject(server, reason, oc, now)
+}
+
+// Keeps at least (100 - MaxEjectionPercent)% of the pool taking traffic
+func can_eject(server *server_struct) bool {
+	p := lookup_pool(server.pool)
+	if p == nil {
+		return false
+	}
+	members := p.members()
+	now := time.Now()
+	ejected := 0
+	for _, s := range members {
+		s.mu.RLock()
+		if s.is_ejected(now) {
+			ejected++
+		}
+		s.mu.RUnlock()
+	}
+	percent := cfg().OutlierDetection.MaxEjectionPercent
+	max_ejected := len(members) * percent / 100
+	if max_ejected < 1 && percent > 0 {
+		max_ejected = 1 // Small pools can still eject their one bad server
+	}
+	if ejected+1 > max_ejected {
+		log.Printf("[WARNING] Not ejecting server %s, pool %s is already at its ejection limit", server.port, server.pool)
+		return false
+	}
+	return true
+}
+
+func eject(server *server_struct, reason string, oc outlier_config, now time.Time) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	o := &server.outlier
+	if now.Sub(o.last_ejection) > time.Duration(oc.MaxEjectionTime)+time.Duration(oc.BaseEjectionTime)*time.Duration(o.ejections) {
+		o.ejections = 0 // Behaved long enough, start the backoff over
+	}
+	o.ejections++
+	length := time.Duration(oc.BaseEjectionTime) * time.Duration(o.ejections)
+	if length > time.Duration(oc.MaxEjectionTime) {
+		length = time.Duration(oc.MaxEjectionTime)
+	}
+	o.ejected = true
+	o.ejected_until = now.Add(length)
+	o.last_ejection = now
+	o.consecutive_errors = 0
+	o.window_start = now
+	o.window_requests = 0
+	o.window_errors = 0
+	log.Printf("[WARNING] Ejected server %s from pool %s for %s (%s, ejection #%d)", server.port, server.pool, length, reason, o.ejections)
+}
+
+// Clears ejections that ran out. Traffic already flows again once ejected_until passes, this just logs it.
+func reinstate_ejected() {
+	now := time.Now()
+	for _, p := range all_pools() {
+		for _, server := range p.members() {
+			server.mu.Lock()
+			if server.outlier.ejected && !now.Before(server.outlier.ejected_until) {
+				server.outlier.ejected = false
+				log.Printf("Server %s in pool %s reinstated after ejection", server.port, server.pool)
+			}
+			server.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	oc := outlier_config{
+		ConsecutiveErrors:  3,
+		ErrorRate:          0.5,
+		MinRequests:        4,
+		Window:             duration(time.Minute),
+		BaseEjectionTime:   duration(time.Minute),
+		MaxEjectionTime:    duration(5 * time.Minute),
+		MaxEjectionPercent: 50,
+	}
+	tests := []struct {
+		name    string
+		results []bool // One per attempt on the first server
+		ejected bool
+	}{
+		{"consecutive errors", []bool{false, false, false}, true},
+		{"a success resets the count", []bool{true, true, true, true, false, false, true, false, false}, false},
+		{"error rate", []bool{true, false, true, false}, true},
+		{"error rate waits for min_requests", []bool{true, false, false}, false},
+		{"low error rate", []bool{true, true, true, false, true, true, false}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := default_config()
+			conf.OutlierDetection = oc
+			use_config(t, conf)
+			empty_pools(t)
+			servers := test_servers(1, 1)
+			for _, s := range servers {
+				get_pool("test").add(s)
+			}
+			for _, ok := range tt.results {
+				record_result(servers[0], ok)
+			}
+			if got := servers[0].is_ejected(time.Now()); got != tt.ejected {
+				t.Fatalf("got ejected=%v, want %v", got, tt.ejected)
+			}
+		})
+	}
+}
+
+func TestOutlierEjectionLimit(t *testing.T) {
+	conf := default_config()
+	conf.OutlierDetection = outlier_config{ConsecutiveErrors: 1, BaseEjectionTime: duration(time.Minute), MaxEjectionTime: duration(time.Minute), MaxEjectionPercent: 50}
+	use_config(t, conf)
+	empty_pools(t)
+	servers := test_servers(1, 1)
+	for _, s := range servers {
+		get_pool("test").add(s)
+	}
+	record_result(servers[0], false)
+	record_result(servers[1], false)
+	now := time.Now()
+	if !servers[0].is_ejected(now) || servers[1].is_ejected(now) {
+		t.Fatal("want only the first server ejected, half the pool at most")
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	oc := outlier_config{BaseEjectionTime: duration(time.Minute), MaxEjectionTime: duration(3 * time.Minute)}
+	start := time.Date(2024, time.January, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		gaps   []time.Duration // Between one ejection and the next
+		length time.Duration   // Of the last ejection
+	}{
+		{"first ejection", nil, time.Minute},
+		{"grows with each ejection", []time.Duration{2 * time.Minute}, 2 * time.Minute},
+		{"capped at max_ejection_time", []time.Duration{2 * time.Minute, 3 * time.Minute, 4 * time.Minute}, 3 * time.Minute},
+		{"forgiven after a quiet spell", []time.Duration{time.Hour}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := test_servers(1)[0]
+			at := start
+			eject(s, "test", oc, at)
+			for _, gap := range tt.gaps {
+				at = at.Add(gap)
+				eject(s, "test", oc, at)
+			}
+			if got := s.outlier.ejected_until.Sub(at); got != tt.length {
+				t.Fatalf("got ejection of %s, want %s", got, tt.length)
+			}
+		})
+	}
+}
+
+func TestReinstateEjected(t *testing.T) {
+	empty_pools(t)
+	servers := test_servers(1, 1)
+	for _, s := range servers {
+		get_pool("test").add(s)
+	}
+	now := time.Now()
+	expired, running := servers[0], servers[1]
+	eject(expired, "test", outlier_config{BaseEjectionTime: duration(time.Minute), MaxEjectionTime: duration(time.Minute)}, now.Add(-2*time.Minute))
+	eject(running, "test", outlier_config{BaseEjectionTime: duration(time.Minute), MaxEjectionTime: duration(time.Minute)}, now)
+	if expired.is_ejected(now) {
+		t.Fatal("expired ejection still keeps traffic away")
+	}
+	reinstate_ejected()
+	if expired.outlier.ejected {
+		t.Fatal("expired ejection not cleared")
+	}
+	if !running.outlier.ejected || !running.is_ejected(time.Now()) {
+		t.Fatal("running ejection cleared")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers that only make sense for a single connection and must not be forwarded
+var hop_by_hop_headers = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Copies every header except the hop-by-hop ones (and anything listed in Connection)
+func copy_headers(dst, src http.Header) {
+	skip := make(map[string]bool)
+	for _, h := range hop_by_hop_headers {
+		skip[h] = true
+	}
+	for _, v := range src.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for name, values := range src {
+		if skip[name] {
+			continue
+		}
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+}
+
+// Builds the upstream URL keeping the original path and query string
+func upstream_url(server *server_struct, request *http.Request) string {
+	url := strings.TrimSuffix(server.URL, "/") + request.URL.EscapedPath()
+	if request.URL.RawQuery != "" {
+		url += "?" + request.URL.RawQuery
+	}
+	return url
+}
+
+func proxyHandler(initial_response http.ResponseWriter, initial_request *http.Request) {
+	conf, rt := route_for(initial_request) // Same config for the whole request even if a reload happens meanwhile
+	if rt == nil {
+		http.Error(initial_response, "No route for this request", http.StatusNotFound)
+		return
+	}
+	if policy := conf.rate_limit_for(rt); policy != already_limited(initial_request) {
+		if !rate_limiter(initial_response, initial_request, rt, policy) {
+			return
+		}
+	}
+	if !quota_limiter(initial_response, initial_request, conf) {
+		return
+	}
+	if !enter_gateway(conf.MaxConcurrentRequests) {
+		http.Error(initial_response, "Gateway is at capacity", http.StatusServiceUnavailable)
+		return
+	}
+	defer leave_gateway()
+
+	pool := lookup_pool(rt.Pool)
+	if pool == nil {
+		http.Error(initial_response, "No upstream servers available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Adding outbound actions for tracing
+	timeouts := conf.timeouts_for(rt)
+	ctx, cancel := request_context(initial_request.Context(), initial_request, timeouts)
+	defer cancel() // Only once the response body has been copied
+	extend_deadlines(initial_response, ctx)
+	tr := otel.Tracer("gateway")
+	ctx, span := tr.Start(ctx, "forward_to_app_server")
+	defer span.End()
+
+	// Streamed through unless a retry might have to send it again
+	max_attempts := rt.Retry.max_attempts()
+	defer initial_request.Body.Close()
+	body, err := read_request_body(initial_response, initial_request, conf.max_body_size_for(rt), max_attempts > 1)
+	if is_body_too_large(err) {
+		http.Error(initial_response, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(initial_response, "Failed to read the body", http.StatusBadRequest)
+		return
+	}
+
+	// Server picked by the pool's balancer. in_queue is bumped until we are done with it.
+	// When the pool is at its concurrency limit this waits in line for a slot.
+	server, err := pool.acquire(ctx, initial_request)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(initial_response, "Timed out waiting for an upstream slot", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(initial_response, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Each retry goes to a server we have not tried yet
+	tried := make(map[*server_struct]bool)
+	var response *http.Response
+	var outcome upstream_outcome
+	for attempt := 1; ; attempt++ {
+		tried[server] = true
+		response, outcome, err = forward_attempt(ctx, upstream_client_for(conf, timeouts), server, initial_request, body, attempt)
+		status := 0
+		if err == nil {
+			status = response.StatusCode
+		}
+		if attempt >= max_attempts || ctx.Err() != nil || !rt.Retry.should_retry(initial_request.Method, err, status) {
+			break
+		}
+		next := pool.pick(initial_request, tried)
+		if next == nil {
+			break // Nobody left to try, go with what we have
+		}
+		log.Printf("Attempt %d to %s failed (status %d, err %v), retrying", attempt, server.URL, status, err)
+		if response != nil {
+			response.Body.Close()
+		}
+		pool.release(server, outcome)
+		server = next
+	}
+	defer pool.release(server, outcome)
+	if err != nil && is_body_too_large(err) {
+		http.Error(initial_response, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil && is_timeout(err) {
+		http.Error(initial_response, "Upstream timed out", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(initial_response, err.Error(), http.StatusBadGateway)
+		return
+	}
+	set_sticky_cookie(initial_response, initial_request, pool.sticky_settings(), server)
+	defer response.Body.Close()
+
+	log.Println("Response status: ", response.Status)
+
+	if rt.Rewrite5xx && response.StatusCode >= 500 {
+		http.Error(initial_response, "Upstream server error", http.StatusBadGateway) // Hides upstream error pages
+		return
+	}
+
+	if rt.Streaming || is_event_stream(response) {
+		clear_deadlines(initial_response)
+	}
+
+	// Send the upstream response back to the client as it arrives: status, headers, body, then trailers
+	response.Header.Del(request_id_header) // Already set by requestIDMiddleware, upstreams often echo it
+	copy_headers(initial_response.Header(), response.Header)
+	announce_trailers(initial_response, response)
+	initial_response.WriteHeader(response.StatusCode)
+	if err := stream_response(initial_response, response); err != nil {
+		// Too late for an error status. Cutting the connection tells the client the body is incomplete.
+		log.Printf("[WARNING] Streaming the response from %s failed: %v", server.URL, err)
+		panic(http.ErrAbortHandler)
+	}
+	copy_trailers(initial_response, response)
+}
+
+// One try against one server, in its own child span. Feeds outlier detection either way and says
+// what the attempt tells the balancer about the server.
+func forward_attempt(ctx context.Context, client *http.Client, server *server_struct, initial_request *http.Request, body *request_body, attempt int) (*http.Response, upstream_outcome, error) {
+	url := upstream_url(server, initial_request)
+	log.Printf("Gateway making a %s call to %s", initial_request.Method, url)
+	ctx, span := otel.Tracer("gateway").Start(ctx, "upstream_attempt", trace.WithAttributes(
+		attribute.Int("attempt", attempt),
+		attribute.String("upstream.url", server.URL),
+		attribute.String("upstream.pool", server.pool),
+	))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, initial_request.Method, url, body.reader())
+	if err != nil {
+		release_probe(server)
+		return nil, upstream_outcome{}, err
+	}
+	req.ContentLength = body.length
+	copy_headers(req.Header, initial_request.Header)
+	set_forwarding_headers(req, initial_request)
+	set_deadline_header(ctx, req)
+
+	start := time.Now()
+	response, err := client.Do(req) // Actually making an API call. Call details stored in req
+	if err != nil && is_body_too_large(err) {
+		release_probe(server)
+		return nil, upstream_outcome{}, err // The client's fault, not the server's
+	}
+	if err != nil && (initial_request.Context().Err() != nil || errors.Is(err, context.Canceled)) {
+		release_probe(server)
+		return nil, upstream_outcome{}, err // The client hung up, that says nothing about the server
+	}
+	outcome := upstream_outcome{rtt: time.Since(start), failed: err != nil}
+	if err != nil {
+		record_result(server, false)
+		record_circuit(server, false, outcome.rtt)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upstream unreachable")
+		return nil, outcome, err
+	}
+	record_result(server, response.StatusCode < 500)
+	record_circuit(server, response.StatusCode < 500, outcome.rtt)
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	if response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, response.Status)
+	}
+	return response, outcome, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A named rate limit that routes point at. MaxRequests per Window for every distinct key.
+type rate_limit_policy struct {
+	Algorithm   string   `json:"algorithm"` // token_bucket, fixed_window or sliding_window (default)
+	Window      duration `json:"window"`
+	MaxRequests int      `json:"max_requests"`
+	Burst       int      `json:"burst"` // token_bucket only: bucket size, defaults to max_requests
+	Key         []string `json:"key"`   // Any mix of ip, api_key, route and header:<name>. Defaults to ip.
+
+	name string // Key in rate_limits, filled in after loading
+}
+
+const (
+	token_bucket   = "token_bucket"
+	fixed_window   = "fixed_window"
+	sliding_window = "sliding_window"
+)
+
+func (p *rate_limit_policy) validate() error {
+	if p.Window <= 0 || p.MaxRequests <= 0 {
+		return fmt.Errorf("window and max_requests must be positive")
+	}
+	switch p.Algorithm {
+	case "", token_bucket, fixed_window, sliding_window:
+	default:
+		return fmt.Errorf("unknown algorithm %q", p.Algorithm)
+	}
+	if p.Burst < 0 {
+		return fmt.Errorf("burst can't be negative")
+	}
+	for _, part := range p.Key {
+		kind, arg, _ := strings.Cut(part, ":")
+		switch {
+		case part == "ip", part == "api_key", part == "consumer", part == "route":
+		case kind == "header" && arg != "":
+		default:
+			return fmt.Errorf("bad key part %q, want ip, api_key, consumer, route or header:<name>", part)
+		}
+	}
+	return nil
+}
+
+func (p *rate_limit_policy) algorithm() string {
+	if p.Algorithm == "" {
+		return sliding_window
+	}
+	return p.Algorithm
+}
+
+func (p *rate_limit_policy) burst() int {
+	if p.Burst == 0 {
+		return p.MaxRequests
+	}
+	return p.Burst
+}
+
+// API keys come in X-API-Key, or as the api_key query parameter for clients that can't set headers
+func api_key(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// Builds the bucket key for this request. Every policy gets its own buckets.
+func (p *rate_limit_policy) bucket_key(r *http.Request, rt *route) string {
+	parts := p.Key
+	if len(parts) == 0 {
+		parts = []string{"ip"}
+	}
+	key := p.name
+	for _, part := range parts {
+		value := ""
+		switch part {
+		case "ip":
+			value = client_ip(r)
+		case "api_key":
+			value = api_key(r)
+		case "consumer":
+			if c := current_consumer(r.Context()); c != nil {
+				value = c.ID
+			}
+		case "route":
+			value = rt.Method + " " + rt.Host + rt.Prefix
+		default: // header:<name>
+			value = r.Header.Get(strings.TrimPrefix(part, "header:"))
+		}
+		key += "|" + value // Requests without the value share one bucket
+	}
+	return key
+}
+
+type rate_limit_result struct {
+	allowed     bool
+	limit       int
+	remaining   int
+	reset       time.Duration // Until the bucket is full / the window starts over
+	retry_after time.Duration // Only meaningful when not allowed
+}
+
+// Per key state for whichever algorithm the policy uses
+type bucket struct {
+	tokens       float64   // token_bucket
+	last         time.Time // token_bucket: last refill
+	window_start time.Time // fixed and sliding window
+	count        int       // Requests in the current window
+	prev_count   int       // sliding_window: requests in the window before
+}
+
+func (b *bucket) take(policy *rate_limit_policy, now time.Time) rate_limit_result {
+	window := time.Duration(policy.Window)
+	switch policy.algorithm() {
+	case token_bucket:
+		// Refill at max_requests per window, never above burst
+		rate := float64(policy.MaxRequests) / window.Seconds()
+		capacity := float64(policy.burst())
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		result := rate_limit_result{limit: policy.burst(), allowed: b.tokens >= 1}
+		if result.allowed {
+			b.tokens--
+		} else {
+			result.retry_after = seconds((1 - b.tokens) / rate)
+		}
+		result.remaining = int(b.tokens)
+		result.reset = seconds((capacity - b.tokens) / rate)
+		return result
+
+	case fixed_window:
+		if now.Sub(b.window_start) >= window {
+			b.window_start = now.Truncate(window)
+			b.count = 0
+		}
+		reset := b.window_start.Add(window).Sub(now)
+		result := rate_limit_result{limit: policy.MaxRequests, reset: reset, allowed: b.count < policy.MaxRequests}
+		if result.allowed {
+			b.count++
+		} else {
+			result.retry_after = reset
+		}
+		result.remaining = policy.MaxRequests - b.count
+		return result
+	}
+
+	// sliding_window: weight the previous window by how much of it still overlaps
+	elapsed := now.Sub(b.window_start)
+	if elapsed >= 2*window {
+		b.window_start = now.Truncate(window)
+		b.prev_count, b.count = 0, 0
+	} else if elapsed >= window {
+		b.window_start = b.window_start.Add(window)
+		b.prev_count, b.count = b.count, 0
+	}
+	overlap := 1 - float64(now.Sub(b.window_start))/float64(window)
+	estimate := float64(b.prev_count)*overlap + float64(b.count)
+	reset := b.window_start.Add(window).Sub(now)
+	result := rate_limit_result{limit: policy.MaxRequests, reset: reset, allowed: estimate+1 <= float64(policy.MaxRequests)}
+	if result.allowed {
+		b.count++
+		estimate++
+	} else {
+		result.retry_after = reset
+	}
+	result.remaining = max(0, policy.MaxRequests-int(math.Ceil(estimate)))
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Whole seconds, rounded up so clients never retry too early
+func header_seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Store errors get logged at most this often so a dead Redis doesn't flood the log
+const store_error_log_interval = 10 * time.Second
+
+var last_store_error atomic.Int64
+
+// Checks the route's policy, sets the X-RateLimit headers and answers 429 when the client is over.
+// Returns false when the request must stop here. A nil policy means the route is not limited.
+func rate_limiter(w http.ResponseWriter, request *http.Request, rt *route, policy *rate_limit_policy) bool {
+	if policy == nil {
+		return true
+	}
+	active := current_rate_store()
+	result, err := active.store.take(request.Context(), policy.bucket_key(request, rt), policy, time.Now())
+	if err != nil {
+		now := time.Now().UnixNano()
+		if last := last_store_error.Load(); now-last > int64(store_error_log_interval) && last_store_error.CompareAndSwap(last, now) {
+			log.Printf("[ERROR] Rate limit store unreachable, failing %s: %v", active.settings.FailureMode, err)
+		}
+		if active.settings.FailureMode == "closed" {
+			http.Error(w, "Rate limiter unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("X-RateLimit-Reset", header_seconds(result.reset))
+	if !result.allowed {
+		conf, _ := route_for(request)
+		bans.strike(client_ip(request), &conf.AutoBan, time.Now())
+		w.Header().Set("Retry-After", header_seconds(result.retry_after))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
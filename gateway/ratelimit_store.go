@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Where rate limit counters live. memory is per gateway, redis is shared by every replica
+// pointed at the same server so limits hold across all of them.
+type rate_limit_store interface {
+	take(ctx context.Context, key string, policy *rate_limit_policy, now time.Time) (rate_limit_result, error)
+	close()
+}
+
+type rate_store_config struct {
+	Type        string   `json:"type"` // memory (default) or redis
+	Address     string   `json:"address"`
+	Password    string   `json:"password"`
+	DB          int      `json:"db"`
+	Timeout     duration `json:"timeout"`      // Per call, keep it short, it sits in front of every request
+	PoolSize    int      `json:"pool_size"`    // Idle connections kept around
+	FailureMode string   `json:"failure_mode"` // open (let requests through) or closed (reject with 503) when the store is down
+
+	// memory only: least recently used keys go first once there are MaxKeys, idle ones after IdleTTL
+	MaxKeys int      `json:"max_keys"`
+	IdleTTL duration `json:"idle_ttl"`
+}
+
+func (sc *rate_store_config) validate() error {
+	switch sc.Type {
+	case "", "memory":
+		if sc.MaxKeys < memory_shards || sc.IdleTTL <= 0 {
+			return fmt.Errorf("max_keys must be at least %d and idle_ttl positive", memory_shards)
+		}
+	case "redis":
+		if sc.Address == "" {
+			return fmt.Errorf("redis needs an address")
+		}
+		if sc.Timeout <= 0 || sc.PoolSize < 1 {
+			return fmt.Errorf("redis timeout and pool_size must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", sc.Type)
+	}
+	switch sc.FailureMode {
+	case "open", "closed":
+	default:
+		return fmt.Errorf("failure_mode must be open or closed, got %q", sc.FailureMode)
+	}
+	return nil
+}
+
+func new_rate_store(sc rate_store_config) rate_limit_store {
+	if sc.Type == "redis" {
+		return &redis_store{client: new_redis_client(sc.Address, sc.Password, sc.DB, time.Duration(sc.Timeout), sc.PoolSize)}
+	}
+	return new_memory_store(sc.MaxKeys, time.Duration(sc.IdleTTL))
+}
+
+// Store in use plus the settings it was built from
+type active_store struct {
+	store    rate_limit_store
+	settings rate_store_config
+}
+
+var rate_store atomic.Pointer[active_store]
+
+func current_rate_store() *active_store {
+	return rate_store.Load()
+}
+
+// Settings the store itself is built from. failure_mode is only read per request, and for memory
+// the redis settings mean nothing, so changing those must not throw the counters away.
+func (sc rate_store_config) build_key() string {
+	if sc.Type == "redis" {
+		// Counters live in Redis, a new client loses nothing
+		return fmt.Sprintf("redis|%s|%s|%d|%s|%d", sc.Address, sc.Password, sc.DB, time.Duration(sc.Timeout), sc.PoolSize)
+	}
+	return fmt.Sprintf("memory|%d|%s", sc.MaxKeys, time.Duration(sc.IdleTTL))
+}
+
+// Builds a new store only when the type, the Redis connection or the memory limits changed. A
+// new memory store starts its counters over. Anything else just updates the settings in use.
+func apply_rate_store_config(sc rate_store_config) {
+	previous := rate_store.Load()
+	if previous != nil && previous.settings.build_key() == sc.build_key() {
+		if previous.settings != sc {
+			rate_store.Store(&active_store{store: previous.store, settings: sc})
+		}
+		return
+	}
+	rate_store.Store(&active_store{store: new_rate_store(sc), settings: sc})
+	if previous != nil {
+		log.Printf("Rate limit store switched to %s", sc.Type)
+		previous.store.close()
+	}
+}
+
+// Each algorithm is one Lua script so the read-modify-write is atomic on the Redis side.
+// Time comes from Redis itself so replicas with skewed clocks still agree.
+// All of them return {allowed, limit, remaining, reset_ms, retry_after_ms}.
+const redis_now = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// KEYS[1] bucket, ARGV: tokens per ms, capacity
+var redis_token_bucket = new_redis_script(redis_now + `
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or capacity
+local last = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - last) * rate)
+local allowed, retry = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+local reset = math.ceil((capacity - tokens) / rate)
+redis.call('PEXPIRE', KEYS[1], reset + 1000)
+return {allowed, capacity, math.floor(tokens), reset, retry}
+`)
+
+// KEYS[1] key prefix, ARGV: window ms, limit
+var redis_fixed_window = new_redis_script(redis_now + `
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local index = math.floor(now / window)
+local key = KEYS[1] .. ':' .. index
+local count = tonumber(redis.call('GET', key) or '0')
+local reset = (index + 1) * window - now
+local allowed, retry = 0, reset
+if count < limit then
+	count = redis.call('INCR', key)
+	redis.call('PEXPIRE', key, window)
+	allowed, retry = 1, 0
+end
+return {allowed, limit, limit - count, reset, retry}
+`)
+
+// KEYS[1] key prefix, ARGV: window ms, limit
+var redis_sliding_window = new_redis_script(redis_now + `
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local index = math.floor(now / window)
+local current_key = KEYS[1] .. ':' .. index
+local current = tonumber(redis.call('GET', current_key) or '0')
+local previous = tonumber(redis.call('GET', KEYS[1] .. ':' .. (index - 1)) or '0')
+local overlap = 1 - (now - index * window) / window
+local estimate = previous * overlap + current
+local reset = (index + 1) * window - now
+local allowed, retry = 0, reset
+if estimate + 1 <= limit then
+	redis.call('INCR', current_key)
+	redis.call('PEXPIRE', current_key, window * 2)
+	estimate = estimate + 1
+	allowed, retry = 1, 0
+end
+return {allowed, limit, math.max(0, limit - math.ceil(estimate)), reset, retry}
+`)
+
+type redis_store struct {
+	client *redis_client
+}
+
+func (rs *redis_store) take(ctx context.Context, key string, policy *rate_limit_policy, now time.Time) (rate_limit_result, error) {
+	// The hash tag keeps every key a script touches in one cluster slot
+	redis_key := "ratelimit:{" + key + "}"
+	window_ms := time.Duration(policy.Window).Milliseconds()
+	var reply any
+	var err error
+	switch policy.algorithm() {
+	case token_bucket:
+		rate := float64(policy.MaxRequests) / float64(window_ms)
+		reply, err = rs.client.eval(ctx, redis_token_bucket, []string{redis_key},
+			strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(policy.burst()))
+	case fixed_window:
+		reply, err = rs.client.eval(ctx, redis_fixed_window, []string{redis_key},
+			strconv.FormatInt(window_ms, 10), strconv.Itoa(policy.MaxRequests))
+	default:
+		reply, err = rs.client.eval(ctx, redis_sliding_window, []string{redis_key},
+			strconv.FormatInt(window_ms, 10), strconv.Itoa(policy.MaxRequests))
+	}
+	if err != nil {
+		return rate_limit_result{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 5 {
+		return rate_limit_result{}, fmt.Errorf("unexpected script reply %v", reply)
+	}
+	numbers := make([]int64, 5)
+	for i, v := range values {
+		if numbers[i], ok = v.(int64); !ok {
+			return rate_limit_result{}, fmt.Errorf("unexpected script reply %v", reply)
+		}
+	}
+	return rate_limit_result{
+		allowed:     numbers[0] == 1,
+		limit:       int(numbers[1]),
+		remaining:   int(numbers[2]),
+		reset:       time.Duration(numbers[3]) * time.Millisecond,
+		retry_after: time.Duration(numbers[4]) * time.Millisecond,
+	}, nil
+}
+
+func (rs *redis_store) close() { rs.client.close() }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// One take at an offset from the start of the test, and what it should answer
+type take_step struct {
+	at   time.Duration
+	want rate_limit_result
+}
+
+// Float math leaves durations a few nanoseconds off
+func close_to(got, want time.Duration) bool {
+	diff := got - want
+	return diff > -time.Microsecond && diff < time.Microsecond
+}
+
+func run_steps(t *testing.T, policy *rate_limit_policy, b *bucket, start time.Time, steps []take_step) {
+	t.Helper()
+	for i, step := range steps {
+		got := b.take(policy, start.Add(step.at))
+		w := step.want
+		if got.allowed != w.allowed || got.limit != w.limit || got.remaining != w.remaining ||
+			!close_to(got.reset, w.reset) || !close_to(got.retry_after, w.retry_after) {
+			t.Fatalf("step %d at +%s: got %+v, want %+v", i, step.at, got, w)
+		}
+	}
+}
+
+// A window boundary, so Truncate lands where the test expects
+var bucket_start = time.Unix(1_700_000_000, 0)
+
+func TestTokenBucket(t *testing.T) {
+	policy := &rate_limit_policy{Algorithm: token_bucket, Window: duration(time.Second), MaxRequests: 10, Burst: 5}
+	b := &bucket{tokens: 5, last: bucket_start} // How memory_store starts a key
+	ok := func(remaining int, reset time.Duration) rate_limit_result {
+		return rate_limit_result{allowed: true, limit: 5, remaining: remaining, reset: reset}
+	}
+	run_steps(t, policy, b, bucket_start, []take_step{
+		// Burst of 5, each take costs a token that refills in 100ms
+		{0, ok(4, 100*time.Millisecond)},
+		{0, ok(3, 200*time.Millisecond)},
+		{0, ok(2, 300*time.Millisecond)},
+		{0, ok(1, 400*time.Millisecond)},
+		{0, ok(0, 500*time.Millisecond)},
+		{0, rate_limit_result{allowed: false, limit: 5, remaining: 0, reset: 500 * time.Millisecond, retry_after: 100 * time.Millisecond}},
+		// Half a token is not enough, the wait is for the other half
+		{50 * time.Millisecond, rate_limit_result{allowed: false, limit: 5, remaining: 0, reset: 450 * time.Millisecond, retry_after: 50 * time.Millisecond}},
+		// 2.5 tokens refilled, one taken
+		{250 * time.Millisecond, ok(1, 350*time.Millisecond)},
+		// A long pause refills to burst and no further
+		{10 * time.Second, ok(4, 100*time.Millisecond)},
+	})
+}
+
+func TestTokenBucketBurstDefaultsToMaxRequests(t *testing.T) {
+	policy := &rate_limit_policy{Algorithm: token_bucket, Window: duration(time.Minute), MaxRequests: 3}
+	b := &bucket{tokens: float64(policy.burst()), last: bucket_start}
+	run_steps(t, policy, b, bucket_start, []take_step{
+		{0, rate_limit_result{allowed: true, limit: 3, remaining: 2, reset: 20 * time.Second}},
+		{0, rate_limit_result{allowed: true, limit: 3, remaining: 1, reset: 40 * time.Second}},
+		{0, rate_limit_result{allowed: true, limit: 3, remaining: 0, reset: time.Minute}},
+		{0, rate_limit_result{allowed: false, limit: 3, remaining: 0, reset: time.Minute, retry_after: 20 * time.Second}},
+	})
+}
+
+func TestFixedWindow(t *testing.T) {
+	policy := &rate_limit_policy{Algorithm: fixed_window, Window: duration(time.Second), MaxRequests: 3}
+	b := &bucket{window_start: bucket_start}
+	ok := func(remaining int, reset time.Duration) rate_limit_result {
+		return rate_limit_result{allowed: true, limit: 3, remaining: remaining, reset: reset}
+	}
+	run_steps(t, policy, b, bucket_start, []take_step{
+		{200 * time.Millisecond, ok(2, 800*time.Millisecond)},
+		{300 * time.Millisecond, ok(1, 700*time.Millisecond)},
+		{400 * time.Millisecond, ok(0, 600*time.Millisecond)},
+		{999 * time.Millisecond, rate_limit_result{allowed: false, limit: 3, remaining: 0, reset: time.Millisecond, retry_after: time.Millisecond}},
+		// The next window starts on the boundary with a full count
+		{time.Second, ok(2, time.Second)},
+		{1500 * time.Millisecond, ok(1, 500*time.Millisecond)},
+		// Windows skipped entirely, the new one is aligned to the window size, not to the last request
+		{5500 * time.Millisecond, ok(2, 500*time.Millisecond)},
+	})
+}
+
+func TestSlidingWindow(t *testing.T) {
+	policy := &rate_limit_policy{Algorithm: sliding_window, Window: duration(time.Second), MaxRequests: 10}
+	b := &bucket{window_start: bucket_start}
+	ok := func(remaining int, reset time.Duration) rate_limit_result {
+		return rate_limit_result{allowed: true, limit: 10, remaining: remaining, reset: reset}
+	}
+	steps := []take_step{}
+	// 6 requests in the first window
+	for i := 1; i <= 6; i++ {
+		steps = append(steps, take_step{500 * time.Millisecond, ok(10-i, 500*time.Millisecond)})
+	}
+	steps = append(steps,
+		// A quarter into the next window 3/4 of the previous one still counts: 4.5, then 5.5 with this one
+		take_step{1250 * time.Millisecond, ok(4, 750*time.Millisecond)},
+		take_step{1250 * time.Millisecond, ok(3, 750*time.Millisecond)},
+		take_step{1250 * time.Millisecond, ok(2, 750*time.Millisecond)},
+		take_step{1250 * time.Millisecond, ok(1, 750*time.Millisecond)},
+		take_step{1250 * time.Millisecond, ok(0, 750*time.Millisecond)},
+		// 9.5 so far, one more would be 10.5
+		take_step{1250 * time.Millisecond, rate_limit_result{allowed: false, limit: 10, remaining: 0, reset: 750 * time.Millisecond, retry_after: 750 * time.Millisecond}},
+		// The previous window fades out: 6 * 0.25 + 5 = 6.5, then 7.5
+		take_step{1750 * time.Millisecond, ok(2, 250*time.Millisecond)},
+		// The window after: the 6 requests of the second one weigh 0.9 = 5.4, plus this one
+		take_step{2100 * time.Millisecond, ok(3, 900*time.Millisecond)},
+		// Two whole windows quiet, nothing carries over
+		take_step{4300 * time.Millisecond, ok(9, 700*time.Millisecond)},
+	)
+	run_steps(t, policy, b, bucket_start, steps)
+}
+
+func TestSlidingWindowIsTheDefault(t *testing.T) {
+	policy := &rate_limit_policy{Window: duration(time.Second), MaxRequests: 2}
+	b := &bucket{window_start: bucket_start}
+	run_steps(t, policy, b, bucket_start, []take_step{
+		{900 * time.Millisecond, rate_limit_result{allowed: true, limit: 2, remaining: 1, reset: 100 * time.Millisecond}},
+		{900 * time.Millisecond, rate_limit_result{allowed: true, limit: 2, remaining: 0, reset: 100 * time.Millisecond}},
+		// A fixed window would allow both again, the sliding one still counts 2 * 0.9
+		{1100 * time.Millisecond, rate_limit_result{allowed: false, limit: 2, remaining: 0, reset: 900 * time.Millisecond, retry_after: 900 * time.Millisecond}},
+	})
+}
+
+func TestHeaderSeconds(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "0",
+		time.Millisecond:        "1",
+		time.Second:             "1",
+		1001 * time.Millisecond: "2",
+		90 * time.Second:        "90",
+	} {
+		if got := header_seconds(d); got != want {
+			t.Errorf("header_seconds(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
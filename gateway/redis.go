@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough of the Redis protocol (RESP2) to run scripts, so we don't pull in a client library.
+// Works against anything that speaks it: Redis, Valkey, KeyDB, Dragonfly.
+type redis_client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redis_conn // Connections ready for reuse
+}
+
+type redis_conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Error replies from the server, as opposed to network trouble
+type redis_error string
+
+func (e redis_error) Error() string { return string(e) }
+
+func new_redis_client(addr, password string, db int, timeout time.Duration, pool_size int) *redis_client {
+	return &redis_client{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *redis_conn, pool_size),
+	}
+}
+
+func (c *redis_client) get_conn(ctx context.Context) (*redis_conn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redis_conn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *redis_client) put_conn(rc *redis_conn) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close() // Pool is full
+	}
+}
+
+// Runs one command. Connections that saw a network error are dropped, not reused.
+func (c *redis_client) do(ctx context.Context, args ...string) (any, error) {
+	rc, err := c.get_conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(c.timeout, args...)
+	var server_err redis_error
+	if err != nil && !errors.As(err, &server_err) {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put_conn(rc)
+	return reply, err
+}
+
+func (c *redis_client) close() {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *redis_conn) do(timeout time.Duration, args ...string) (any, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.read_reply()
+}
+
+func (rc *redis_conn) read_line() (string, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func (rc *redis_conn) read_reply() (any, error) {
+	line, err := rc.read_line()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redis_error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // $-1 is a nil bulk string
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = rc.read_reply(); err != nil {
+				var server_err redis_error
+				if !errors.As(err, &server_err) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Lua script plus its SHA1 so it only crosses the wire once per server
+type redis_script struct {
+	source string
+	sha    string
+}
+
+func new_redis_script(source string) *redis_script {
+	sum := sha1.Sum([]byte(source))
+	return &redis_script{source: source, sha: hex.EncodeToString(sum[:])}
+}
+
+func (c *redis_client) eval(ctx context.Context, script *redis_script, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVALSHA", script.sha, strconv.Itoa(len(keys))}, keys...)
+	reply, err := c.do(ctx, append(cmd, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", script.source
+		reply, err = c.do(ctx, append(cmd, args...)...)
+	}
+	return reply, err
+}
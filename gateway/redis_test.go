@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		want  any
+		fails bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"negative integer", ":-7\r\n", int64(-7), false},
+		{"bulk string", "$5\r\nhello\r\n", "hello", false},
+		{"bulk string with CRLF inside", "$4\r\na\r\nb\r\n", "a\r\nb", false},
+		{"empty bulk string", "$0\r\n\r\n", "", false},
+		{"nil bulk string", "$-1\r\n", nil, false},
+		{"array", "*3\r\n:1\r\n$2\r\nhi\r\n+x\r\n", []any{int64(1), "hi", "x"}, false},
+		{"array with nil", "*2\r\n$-1\r\n:5\r\n", []any{nil, int64(5)}, false},
+		{"nested array", "*2\r\n*1\r\n:1\r\n:2\r\n", []any{[]any{int64(1)}, int64(2)}, false},
+		{"empty array", "*0\r\n", []any{}, false},
+		{"nil array", "*-1\r\n", nil, false},
+		{"error inside array leaves a nil", "*3\r\n:1\r\n-ERR bad item\r\n:3\r\n", []any{int64(1), nil, int64(3)}, false},
+		{"error", "-ERR wrong\r\n", nil, true},
+		{"not a number", ":abc\r\n", nil, true},
+		{"bad bulk length", "$x\r\n", nil, true},
+		{"truncated bulk string", "$10\r\nshort\r\n", nil, true},
+		{"truncated array", "*3\r\n:1\r\n", nil, true},
+		{"unknown type", "?what\r\n", nil, true},
+		{"empty line", "\r\n", nil, true},
+		{"nothing", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &redis_conn{reader: bufio.NewReader(strings.NewReader(tt.raw))}
+			got, err := rc.read_reply()
+			if (err != nil) != tt.fails {
+				t.Fatalf("got error %v", err)
+			}
+			if !tt.fails && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisErrorReply(t *testing.T) {
+	rc := &redis_conn{reader: bufio.NewReader(strings.NewReader("-NOSCRIPT No matching script\r\n"))}
+	_, err := rc.read_reply()
+	var server_err redis_error
+	if !errors.As(err, &server_err) || string(server_err) != "NOSCRIPT No matching script" {
+		t.Fatalf("got %v, want a redis_error", err)
+	}
+}
+
+// A server on the other end of a net.Pipe that answers each command with the next canned reply
+// and hands the commands it got to the test. Closes the connection when it runs out of replies.
+func fake_redis(t *testing.T, replies ...string) (*redis_client, <-chan []string) {
+	t.Helper()
+	client_end, server_end := net.Pipe()
+	commands := make(chan []string, len(replies))
+	go func() {
+		defer server_end.Close()
+		defer close(commands)
+		reader := bufio.NewReader(server_end)
+		for _, reply := range replies {
+			cmd, err := read_command(reader)
+			if err != nil {
+				return
+			}
+			commands <- cmd
+			if _, err := io.WriteString(server_end, reply); err != nil {
+				return
+			}
+		}
+	}()
+	c := new_redis_client("pipe", "", 0, time.Second, 1)
+	c.idle <- &redis_conn{conn: client_end, reader: bufio.NewReader(client_end)}
+	t.Cleanup(func() { client_end.Close() })
+	return c, commands
+}
+
+// Reads one command the way a server would: an array of bulk strings
+func read_command(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "*") {
+		return nil, errors.New("not a command")
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisEvalNoScript(t *testing.T) {
+	script := new_redis_script("return 1")
+	c, commands := fake_redis(t, "-NOSCRIPT No matching script. Please use EVAL.\r\n", ":1\r\n", ":1\r\n")
+	ctx := context.Background()
+
+	reply, err := c.eval(ctx, script, []string{"k"}, "a")
+	if err != nil || reply != int64(1) {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+	want := [][]string{
+		{"EVALSHA", script.sha, "1", "k", "a"},
+		{"EVAL", "return 1", "1", "k", "a"},
+	}
+	for _, w := range want {
+		if got := <-commands; !reflect.DeepEqual(got, w) {
+			t.Fatalf("server got %q, want %q", got, w)
+		}
+	}
+	// The error reply didn't cost us the connection, and the script is cached now
+	if reply, err = c.eval(ctx, script, []string{"k"}, "a"); err != nil || reply != int64(1) {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+	if got := <-commands; got[0] != "EVALSHA" {
+		t.Fatalf("server got %q, want EVALSHA again", got)
+	}
+}
+
+func TestRedisEvalOtherError(t *testing.T) {
+	script := new_redis_script("return 1")
+	c, commands := fake_redis(t, "-ERR Error running script\r\n")
+	_, err := c.eval(context.Background(), script, []string{"k"})
+	var server_err redis_error
+	if !errors.As(err, &server_err) {
+		t.Fatalf("got %v, want the server's error", err)
+	}
+	<-commands
+	if _, more := <-commands; more {
+		t.Fatal("retried with EVAL although the script exists")
+	}
+	if len(c.idle) != 1 {
+		t.Fatal("connection dropped after an error reply")
+	}
+}
+
+func TestRedisNetworkErrorDropsConnection(t *testing.T) {
+	c, _ := fake_redis(t)  // Hangs up right away
+	c.addr = "127.0.0.1:1" // Nothing to redial either
+	if _, err := c.do(context.Background(), "PING"); err == nil {
+		t.Fatal("no error from a closed connection")
+	}
+	if len(c.idle) != 0 {
+		t.Fatal("broken connection went back to the pool")
+	}
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	policy := &rate_limit_policy{name: "test", Algorithm: sliding_window, Window: duration(time.Second), MaxRequests: 10}
+	tests := []struct {
+		name  string
+		reply string
+		want  rate_limit_result
+		fails bool
+	}{
+		{"allowed", "*5\r\n:1\r\n:10\r\n:9\r\n:1000\r\n:0\r\n",
+			rate_limit_result{allowed: true, limit: 10, remaining: 9, reset: time.Second}, false},
+		{"denied", "*5\r\n:0\r\n:10\r\n:0\r\n:400\r\n:250\r\n",
+			rate_limit_result{allowed: false, limit: 10, remaining: 0, reset: 400 * time.Millisecond, retry_after: 250 * time.Millisecond}, false},
+		{"too short", "*4\r\n:1\r\n:10\r\n:9\r\n:1000\r\n", rate_limit_result{}, true},
+		{"not an array", ":1\r\n", rate_limit_result{}, true},
+		{"nil array", "*-1\r\n", rate_limit_result{}, true},
+		{"string item", "*5\r\n:1\r\n$2\r\n10\r\n:9\r\n:1000\r\n:0\r\n", rate_limit_result{}, true},
+		{"nil item", "*5\r\n:1\r\n:10\r\n$-1\r\n:1000\r\n:0\r\n", rate_limit_result{}, true},
+		{"error inside the array", "*5\r\n:1\r\n:10\r\n-ERR oops\r\n:1000\r\n:0\r\n", rate_limit_result{}, true},
+		{"script error", "-ERR user_script:1: boom\r\n", rate_limit_result{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, commands := fake_redis(t, tt.reply)
+			rs := &redis_store{client: c}
+			got, err := rs.take(context.Background(), "test|10.0.0.1", policy, time.Now())
+			if (err != nil) != tt.fails {
+				t.Fatalf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			cmd := <-commands
+			want := []string{"EVALSHA", redis_sliding_window.sha, "1", "ratelimit:{test|10.0.0.1}", "1000", "10"}
+			if !reflect.DeepEqual(cmd, want) {
+				t.Fatalf("server got %q, want %q", cmd, want)
+			}
+		})
+	}
+}
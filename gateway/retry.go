@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// Per route retry settings. Without one every request gets exactly one attempt.
+type retry_policy struct {
+	MaxAttempts         int   `json:"max_attempts"`           // Total attempts including the first one
+	RetryOnStatus       []int `json:"retry_on_status"`        // Upstream status codes worth another try, e.g. 502, 503
+	RetryOnConnectError bool  `json:"retry_on_connect_error"` // Could not reach the server at all, always safe
+	RetryOnTimeout      bool  `json:"retry_on_timeout"`       // The server may have done the work already
+	RetryNonIdempotent  bool  `json:"retry_non_idempotent"`   // Also retry POST/PATCH, only if the upstream can cope
+}
+
+// RFC 9110 idempotent methods
+var idempotent_methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func (rp *retry_policy) max_attempts() int {
+	if rp == nil || rp.MaxAttempts < 1 {
+		return 1
+	}
+	return rp.MaxAttempts
+}
+
+// Dial failures mean the request never left the gateway
+func is_connect_error(err error) bool {
+	var op_err *net.OpError
+	return errors.As(err, &op_err) && op_err.Op == "dial"
+}
+
+func is_timeout(err error) bool {
+	var net_err net.Error
+	if errors.As(err, &net_err) && net_err.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Whether an attempt that ended with err/status deserves another go on a different server
+func (rp *retry_policy) should_retry(method string, err error, status int) bool {
+	if rp == nil {
+		return false
+	}
+	// A connect timeout is still a connect error: nothing reached the server, so any method is fine
+	if err != nil && is_connect_error(err) {
+		return rp.RetryOnConnectError
+	}
+	if !idempotent_methods[method] && !rp.RetryNonIdempotent {
+		return false
+	}
+	if err != nil {
+		if is_timeout(err) {
+			return rp.RetryOnTimeout
+		}
+		return false
+	}
+	return slices.Contains(rp.RetryOnStatus, status)
+}
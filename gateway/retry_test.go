@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestShouldRetry(t *testing.T) {
+	connect_error := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	connect_timeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	read_timeout := fmt.Errorf("reading response: %w", context.DeadlineExceeded)
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	policy := &retry_policy{MaxAttempts: 3, RetryOnStatus: []int{502, 503}, RetryOnConnectError: true, RetryOnTimeout: true}
+	tests := []struct {
+		name   string
+		policy *retry_policy
+		method string
+		err    error
+		status int
+		want   bool
+	}{
+		{"no policy", nil, http.MethodGet, connect_error, 0, false},
+		{"listed status", policy, http.MethodGet, nil, 503, true},
+		{"other status", policy, http.MethodGet, nil, 500, false},
+		{"success", policy, http.MethodGet, nil, 200, false},
+		{"connect error", policy, http.MethodGet, connect_error, 0, true},
+		{"connect error on POST never reached the server", policy, http.MethodPost, connect_error, 0, true},
+		{"connect timeout is a connect error", policy, http.MethodPost, connect_timeout, 0, true},
+		{"connect errors not retried", &retry_policy{RetryOnTimeout: true}, http.MethodGet, connect_error, 0, false},
+		{"timeout", policy, http.MethodGet, read_timeout, 0, true},
+		{"timeouts not retried", &retry_policy{RetryOnConnectError: true}, http.MethodGet, read_timeout, 0, false},
+		{"timeout on POST", policy, http.MethodPost, read_timeout, 0, false},
+		{"status on POST", policy, http.MethodPost, nil, 503, false},
+		{"PUT is idempotent", policy, http.MethodPut, nil, 503, true},
+		{"PATCH is not", policy, http.MethodPatch, nil, 503, false},
+		{"non idempotent allowed", &retry_policy{RetryOnStatus: []int{503}, RetryOnTimeout: true, RetryNonIdempotent: true}, http.MethodPost, read_timeout, 0, true},
+		{"other errors", policy, http.MethodGet, reset, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.should_retry(tt.method, tt.err, tt.status); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	tests := []struct {
+		policy *retry_policy
+		want   int
+	}{
+		{nil, 1},
+		{&retry_policy{}, 1},
+		{&retry_policy{MaxAttempts: 3}, 3},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.max_attempts(); got != tt.want {
+			t.Errorf("%+v: got %d attempts, want %d", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// One entry of the routing table. Empty fields match anything.
+type route struct {
+	Prefix string `json:"prefix"`
+	Host   string `json:"host"`
+	Method string `json:"method"`
+	Pool   string `json:"pool"`
+
+	RateLimit string          `json:"rate_limit"` // Name from rate_limits, empty means the default policy
+	Retry     *retry_policy   `json:"retry"`
+	Timeouts  *timeout_policy `json:"timeouts"` // Fields left out fall back to the top level timeouts
+
+	MaxBodySize int64 `json:"max_body_size"` // Bytes, 0 uses the top level max_body_size
+	Rewrite5xx  bool  `json:"rewrite_5xx"`   // Replace upstream 5xx responses with a plain 502 instead of passing them on
+	Streaming   bool  `json:"streaming"`     // Long lived responses, the server's read and write timeouts don't apply to them. Always on for text/event-stream.
+
+	Auth   []string          `json:"auth"`   // Authenticators that may let a request in, any one will do. Empty means open.
+	Scopes []string          `json:"scopes"` // OAuth2 scopes the consumer needs, all of them
+	Claims map[string]string `json:"claims"` // Claims the consumer needs, e.g. {"role": "admin"}
+
+	AllowIPs []string `json:"allow_ips"` // IPs or CIDRs, when set nobody else gets in
+	DenyIPs  []string `json:"deny_ips"`  // Checked before allow_ips
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+}
+
+// Host header without the port, lower cased
+func request_host(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		host = request.Host // No port in the Host header
+	}
+	return strings.ToLower(host)
+}
+
+func (rt *route) matches(request *http.Request) bool {
+	if rt.Method != "" && !strings.EqualFold(rt.Method, request.Method) {
+		return false
+	}
+	if rt.Host != "" && !strings.EqualFold(rt.Host, request_host(request)) {
+		return false
+	}
+	if rt.Prefix != "" && !path_has_prefix(request.URL.Path, rt.Prefix) {
+		return false
+	}
+	return true
+}
+
+// "/echo" matches "/echo" and "/echo/x" but not "/echoes"
+func path_has_prefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+type routed_key struct{}
+
+// Config and route authMiddleware matched the request against
+type routed struct {
+	conf    *gateway_config
+	rt      *route
+	limited *rate_limit_policy // Already taken before authentication, proxyHandler doesn't take it twice
+}
+
+// The route picked by authMiddleware, or a fresh match when the request did not come through it
+func route_for(request *http.Request) (*gateway_config, *route) {
+	if m, ok := request.Context().Value(routed_key{}).(routed); ok {
+		return m.conf, m.rt
+	}
+	conf := cfg()
+	return conf, match_route(conf, request)
+}
+
+// Policy authMiddleware already charged the request to, nil if none
+func already_limited(request *http.Request) *rate_limit_policy {
+	m, _ := request.Context().Value(routed_key{}).(routed)
+	return m.limited
+}
+
+// Routes are checked top to bottom, first match wins. Keep the catch-all last.
+func match_route(c *gateway_config, request *http.Request) *route {
+	for i := range c.Routes {
+		if c.Routes[i].matches(request) {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
@@ -1,100 +1,364 @@
 package main
 
 import (
-	"container/heap"
-	"fmt"
+	"container/list"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
 )
 
 type server_struct struct {
-	URL string
-	port string
-	mu sync.RWMutex
-	in_queue int
-	index int
-	alive bool
+	URL          string
+	port         string
+	pool         string
+	mu           sync.RWMutex
+	in_queue     int
+	index        int
+	alive        bool
+	static       bool   // Came from the config file rather than /registerServer
+	owner        string // Client certificate identity that registered it, only that identity may remove it
 	last_updated int64
+
+	// Health check streaks, guarded by mu
+	passes   int
+	failures int
+
+	outlier outlier_state // Passive checks from live traffic, guarded by mu
+	circuit circuit_state // Guarded by mu
+
+	// Load balancing inputs, guarded by the pool lock like in_queue
+	weight          int
+	latency_ewma    float64 // Milliseconds
+	latency_updated time.Time
+	added           time.Time
+	slow_start      time.Duration // Copied from the pool config, 0 means full weight right away
+
+	// Whatever the server told us about itself at registration
+	zone    string
+	version string
+	tags    []string
 }
 
-var servers = make(map[string]*server_struct)	//string port and value is servers struct
+// A new server starts at this share of its weight and ramps up linearly over the slow start window
+const slow_start_floor = 0.1
 
-// Heap for queue
-type ServerHeap []*server_struct // Get the server with the lowest load (queue)
-func (sh ServerHeap) Len() int           { return len(sh) }
-func (sh ServerHeap) Less(i, j int) bool { return sh[i].in_queue < sh[j].in_queue}
-func (sh ServerHeap) Swap(i, j int) {
-    sh[i], sh[j] = sh[j], sh[i]
-	sh[i].index = i
-	sh[j].index = j
+// Share of traffic this server should get relative to the others in its pool
+func (s *server_struct) effective_weight() float64 {
+	weight := float64(max(s.weight, 1))
+	if s.slow_start <= 0 {
+		return weight
+	}
+	ramp := float64(time.Since(s.added)) / float64(s.slow_start)
+	if ramp >= 1 {
+		return weight
+	}
+	return weight * max(ramp, slow_start_floor)
 }
-func (sh *ServerHeap) Push(element any){
-	n := len(*sh)
-	element.(*server_struct).index = n
-	*sh = append(*sh, element.(*server_struct))
+
+// Up according to the health checks, not ejected by outlier detection and its circuit lets requests through
+func (s *server_struct) available() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	return s.alive && !s.is_ejected(now) && s.circuit_permits(now)
 }
-func (sh *ServerHeap) Pop() any {
-	// Internally the first element is swapped with the last one. We need the last element and heapify the first n-1
-	old_heap := *sh
-	n := len(old_heap)
-	x := old_heap[n-1]
-	x.index = -1 // mark as removed
-	*sh = old_heap[0 : n-1]
-	return x
+
+// A named group of interchangeable servers. Routes point at pools, app servers register into them.
+type upstream_pool struct {
+	name         string
+	mu           sync.Mutex                // Guards servers, the balancer and every in_queue in the pool
+	servers      map[string]*server_struct //string port and value is servers struct
+	balancer     Balancer
+	balancer_key string         // Settings the balancer was built from, to spot changes on reload
+	sticky       *sticky_config // nil unless the pool pins clients with a cookie
+	slow_start   time.Duration
+
+	// Concurrency limiting, see concurrency.go
+	limits   concurrency_config
+	adaptive *adaptive_limiter
+	inflight int
+	queue    *list.List // Channels of requests waiting for a slot, oldest first
 }
 
-var sh ServerHeap //Actual global variable
+const default_pool = "default"
+
+var pools = make(map[string]*upstream_pool)
+var pools_mutex sync.RWMutex
 
-func isAlive(url string, port int) bool{
-	resp, err := http.Get("http://" + url + ":" + strconv.Itoa(port) + "/health")
-	if err!=nil{
+func new_pool(name string) *upstream_pool {
+	p := &upstream_pool{
+		name:    name,
+		servers: make(map[string]*server_struct),
+		queue:   list.New(),
+	}
+	var pc pool_config
+	if c := cfg(); c != nil {
+		pc = c.Pools[name]
+	}
+	p.configure(pc)
+	return p
+}
+
+// Applies the balancing settings, carrying the current members over to a new balancer if the
+// strategy changed. Bad settings were already rejected by config validation. Caller holds p.mu
+// unless the pool is brand new.
+func (p *upstream_pool) configure(pc pool_config) {
+	p.sticky = pc.Sticky
+	p.configure_limits(pc.Concurrency)
+	p.slow_start = time.Duration(pc.SlowStart)
+	for _, s := range p.servers {
+		s.slow_start = p.slow_start
+	}
+	if hb, ok := p.balancer.(*heap_balancer); ok {
+		hb.settled = false // A longer slow_start can put servers back into ramping up
+	}
+	if pc.Balancer == "" {
+		pc.Balancer = default_balancer
+	}
+	key := pc.Balancer + "|" + pc.HashOn
+	if p.balancer != nil && p.balancer_key == key {
+		return
+	}
+	b, err := new_balancer(pc)
+	if err != nil {
+		log.Printf("[ERROR] Pool %s: %v", p.name, err)
+		return
+	}
+	for _, s := range p.servers {
+		b.Add(s)
+	}
+	if p.balancer != nil {
+		log.Printf("Pool %s now balances with %s", p.name, pc.Balancer)
+	}
+	p.balancer = b
+	p.balancer_key = key
+}
+
+// Returns the pool with that name, nil if nobody registered into it yet
+func lookup_pool(name string) *upstream_pool {
+	pools_mutex.RLock()
+	defer pools_mutex.RUnlock()
+	return pools[name]
+}
+
+// Returns the pool with that name, creating it on first use
+func get_pool(name string) *upstream_pool {
+	if name == "" {
+		name = default_pool
+	}
+	pools_mutex.Lock()
+	defer pools_mutex.Unlock()
+	p, exists := pools[name]
+	if !exists {
+		p = new_pool(name)
+		pools[name] = p
+		log.Printf("Created upstream pool %s", name)
+	}
+	return p
+}
+
+// Snapshot of all pools sorted by name, so callers can iterate without holding pools_mutex
+func all_pools() []*upstream_pool {
+	pools_mutex.RLock()
+	defer pools_mutex.RUnlock()
+	list := make([]*upstream_pool, 0, len(pools))
+	for _, p := range pools {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Snapshot of the servers in a pool
+func (p *upstream_pool) members() []*server_struct {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]*server_struct, 0, len(p.servers))
+	for _, s := range p.servers {
+		list = append(list, s)
+	}
+	return list
+}
+
+func (p *upstream_pool) add(server *server_struct) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.servers[server.port]; exists {
 		return false
 	}
-	defer resp.Body.Close()
+	server.pool = p.name
+	server.added = time.Now()
+	server.slow_start = p.slow_start
+	p.servers[server.port] = server
+	p.balancer.Add(server)
 	return true
 }
 
-func remove_server(server *server_struct) bool {
-	// Remove from heap
-	found := false
-	for index, s := range(sh) {
-		if s.port == server.port {
-			heap.Remove(&sh, index)
-			found = true
-			break
+// Asks the balancer for a healthy server that is not in skip and counts the request against it.
+// Never waits: nil when nothing is free. Every successful pick must be paired with a release call.
+func (p *upstream_pool) pick(r *http.Request, skip map[*server_struct]bool) *server_struct {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	server, _ := p.try_pick(r, skip)
+	return server
+}
+
+// full reports that servers are up but every one of them is at a concurrency limit. Caller holds p.mu.
+func (p *upstream_pool) try_pick(r *http.Request, skip map[*server_struct]bool) (*server_struct, bool) {
+	healthy := func(s *server_struct) bool {
+		return !skip[s] && s.available()
+	}
+	usable := func(s *server_struct) bool {
+		return healthy(s) && p.under_server_limit(s)
+	}
+	if limit := p.pool_limit(); limit > 0 && p.inflight >= limit {
+		return nil, true
+	}
+	server := p.sticky_server(r, usable) // A sticky cookie beats the balancer
+	if server == nil {
+		server = p.balancer.Pick(r, usable)
+	}
+	if server == nil {
+		// Scan instead of asking the balancer again, Pick moves round robin schedules along
+		for _, s := range p.servers {
+			if healthy(s) {
+				return nil, true
+			}
 		}
+		return nil, false
 	}
-	// Remove from map
-	if _, ok := servers[server.port]; ok {
-		delete(servers, server.port)
-		found = true
+	server.circuit_admit(time.Now())
+	server.in_queue++
+	p.inflight++
+	p.balancer.Update(server)
+	return server, false
+}
+
+// What one attempt says about the server it went to. The zero value says nothing: the client went
+// away or the request never reached the server.
+type upstream_outcome struct {
+	rtt    time.Duration // Until the response headers, or until the attempt failed
+	failed bool          // Refused, reset or timed out
+}
+
+func (p *upstream_pool) release(server *server_struct, outcome upstream_outcome) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	server.in_queue--
+	p.inflight--
+	if outcome.rtt > 0 {
+		server.observe_latency(outcome, time.Now())
 	}
-	if found {
-		log.Printf("Deleted server %s cleanly", server.port)
-		return true
+	if p.adaptive != nil {
+		p.adaptive.observe(outcome)
 	}
+	p.balancer.Update(server)
+	p.wake_waiters()
+}
 
-	return false // server not found in heap or map
+func (p *upstream_pool) remove(port string) *server_struct {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	server, exists := p.servers[port]
+	if !exists {
+		return nil
+	}
+	delete(p.servers, port)
+	p.balancer.Remove(server)
+	return server
+}
+
+// Held from looking a port up to adding it, so two registrations can't put one port into two pools
+var registry_mutex sync.Mutex
+
+// Adds the server unless its port is already in some pool
+func add_unique(pool *upstream_pool, server *server_struct) bool {
+	registry_mutex.Lock()
+	defer registry_mutex.Unlock()
+	if find_server(server.port) != nil {
+		return false
+	}
+	return pool.add(server)
+}
+
+// Ports are unique across the gateway, so this checks every pool
+func find_server(port string) *server_struct {
+	for _, p := range all_pools() {
+		p.mu.Lock()
+		server, exists := p.servers[port]
+		p.mu.Unlock()
+		if exists {
+			return server
+		}
+	}
+	return nil
+}
+
+// A server is alive when its health endpoint answers with a 2xx in time
+func isAlive(client *http.Client, url string) bool {
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Drain so the connection gets reused
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func remove_server(server *server_struct) bool {
+	p := lookup_pool(server.pool)
+	if p == nil || p.remove(server.port) == nil {
+		return false // server not found in heap or map
+	}
+	log.Printf("Deleted server %s from pool %s cleanly", server.port, server.pool)
+	return true
+}
+
+// Records one probe result and flips alive once a streak crosses its threshold
+func (s *server_struct) record_probe(ok bool, hc heartbeat_config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last_updated = time.Now().Unix()
+	if ok {
+		s.passes++
+		s.failures = 0
+		if !s.alive && s.passes >= hc.HealthyThreshold {
+			s.alive = true
+			log.Printf("Server %s in pool %s is healthy again", s.port, s.pool)
+		}
+		return
+	}
+	s.failures++
+	s.passes = 0
+	if s.alive && s.failures >= hc.UnhealthyThreshold {
+		s.alive = false
+		log.Printf("[WARNING] Server %s in pool %s failed %d health checks, taking it out", s.port, s.pool, s.failures)
+	}
 }
 
 func start_heartbeat() {
 	for {
-		for UID, server := range servers {
-			fmt.Println("Found server " + UID)
-			// server.mu.Lock()
-			// if isAlive(UID, server.port){
-			// 	server.alive = true
-			// } else{
-			// 	// TODO set it on the mock_api side too
-			// 	server.alive = false
-			// }
-			server.last_updated = time.Now().Unix()
-			// server.mu.Unlock()
+		conf := cfg()
+		hc := conf.Heartbeat
+		// Shares the proxy's connections and upstream TLS settings, with the probe timeout on top
+		shared := upstream_client_for(conf, timeout_policy{Connect: hc.Timeout})
+		client := &http.Client{Transport: shared.Transport, Timeout: time.Duration(hc.Timeout)}
+		var wg sync.WaitGroup
+		for _, p := range all_pools() {
+			for _, server := range p.members() {
+				wg.Add(1)
+				go func() { // Probe in parallel so one slow server doesn't hold up the rest
+					defer wg.Done()
+					server.record_probe(isAlive(client, server.URL+hc.Path), hc)
+				}()
+			}
 		}
+		wg.Wait()
+		reinstate_ejected()
 		log.Println("Heartbeat check done")
-		time.Sleep(5*time.Second)
+		time.Sleep(time.Duration(hc.Interval))
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Request body as it goes upstream. Only routes that may retry keep a copy so every attempt can
+// replay it, everything else streams straight through.
+type request_body struct {
+	buffered []byte
+	stream   io.Reader // nil when buffered
+	length   int64     // -1 when unknown (chunked)
+}
+
+// Caps the body at limit bytes (0 is no cap) and buffers it when replayable.
+// Too large bodies come back as *http.MaxBytesError.
+func read_request_body(w http.ResponseWriter, r *http.Request, limit int64, replayable bool) (*request_body, error) {
+	if limit > 0 {
+		if r.ContentLength > limit {
+			return nil, &http.MaxBytesError{Limit: limit} // No need to read it to know
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	if !replayable {
+		return &request_body{stream: r.Body, length: r.ContentLength}, nil
+	}
+	buffered, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &request_body{buffered: buffered, length: int64(len(buffered))}, nil
+}
+
+// Body for one attempt
+func (b *request_body) reader() io.Reader {
+	if b.stream == nil {
+		return bytes.NewReader(b.buffered)
+	}
+	if b.length == 0 {
+		return http.NoBody
+	}
+	return b.stream
+}
+
+func is_body_too_large(err error) bool {
+	var too_large *http.MaxBytesError
+	return errors.As(err, &too_large)
+}
+
+// Route cap on request bodies, falling back to the gateway wide one
+func (c *gateway_config) max_body_size_for(rt *route) int64 {
+	if rt.MaxBodySize > 0 {
+		return rt.MaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+// The server's read/write timeouts are there for slow clients, a proxied request gets as long as its
+// own total timeout instead. Without one the server's timeouts stay, until clear_deadlines.
+func extend_deadlines(w http.ResponseWriter, ctx context.Context) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	set_deadlines(w, d.Add(time.Second)) // Time to write the 504 once the context runs out
+}
+
+// Lifts the server's timeouts for a response that is long lived by design, such as an event stream.
+// The request context still ends it at the route's total timeout, if there is one.
+func clear_deadlines(w http.ResponseWriter) {
+	set_deadlines(w, time.Time{})
+}
+
+func set_deadlines(w http.ResponseWriter, deadline time.Time) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("[WARNING] Could not change the read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("[WARNING] Could not change the write deadline: %v", err)
+	}
+}
+
+func is_event_stream(response *http.Response) bool {
+	media_type, _, _ := strings.Cut(response.Header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(media_type), "text/event-stream")
+}
+
+// Copies the upstream body to the client as it arrives. Event streams and bodies of unknown length
+// are flushed after every read so nothing sits in a buffer waiting for more.
+func stream_response(w http.ResponseWriter, response *http.Response) error {
+	flush := is_event_stream(response) || response.ContentLength == -1
+	rc := http.NewResponseController(w)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, read_err := response.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err // Client went away
+			}
+			if flush {
+				if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return err
+				}
+			}
+		}
+		if read_err == io.EOF {
+			return nil
+		}
+		if read_err != nil {
+			return read_err
+		}
+	}
+}
+
+// Lists the upstream's declared trailers in our own Trailer header, which has to go out before the body
+func announce_trailers(w http.ResponseWriter, response *http.Response) {
+	for name := range response.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+}
+
+// Trailers are only known once the body has been read. The prefix also covers ones the upstream
+// sent without declaring them first.
+func copy_trailers(w http.ResponseWriter, response *http.Response) {
+	for name, values := range response.Trailer {
+		for _, v := range values {
+			w.Header().Add(http.TrailerPrefix+name, v)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Points every route at one pool holding upstream, with no rate limits in the way. Returns the
+// config so the test can adjust it further.
+func proxy_to(t *testing.T, upstream *httptest.Server, rt route) *gateway_config {
+	t.Helper()
+	conf, err := read_config(filepath.Join(t.TempDir(), "gateway.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.Pool = "test"
+	conf.Routes = []route{rt}
+	conf.RateLimits = map[string]*rate_limit_policy{}
+	use_config(t, conf)
+	empty_pools(t)
+	u, _ := url.Parse(upstream.URL)
+	get_pool("test").add(&server_struct{URL: upstream.URL, port: u.Port(), alive: true})
+	return conf
+}
+
+func TestStreamingDeadlines(t *testing.T) {
+	const write_timeout = 100 * time.Millisecond
+	tests := []struct {
+		name         string
+		content_type string
+		streaming    bool
+		total        time.Duration
+		complete     bool
+	}{
+		{"event stream outlives the write timeout", "text/event-stream", false, 0, true},
+		{"streaming route outlives the write timeout", "application/x-ndjson", true, 0, true},
+		{"other responses keep the write timeout without a total timeout", "text/plain", false, 0, false},
+		{"total timeout extends the write timeout", "text/plain", false, 2 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.content_type)
+				io.WriteString(w, "first\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(3 * write_timeout)
+				io.WriteString(w, "second\n")
+			}))
+			defer upstream.Close()
+			conf := proxy_to(t, upstream, route{Streaming: tt.streaming})
+			conf.Timeouts.Total = duration(tt.total)
+
+			gateway := httptest.NewUnstartedServer(http.HandlerFunc(proxyHandler))
+			gateway.Config.WriteTimeout = write_timeout
+			gateway.Start()
+			defer gateway.Close()
+
+			response, err := http.Get(gateway.URL + "/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			complete := err == nil && string(body) == "first\nsecond\n"
+			if complete != tt.complete {
+				t.Fatalf("got body %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   route
+		body    string
+		chunked bool // Sent without a Content-Length, so only reading it finds out
+		status  int
+	}{
+		{"within the limit", route{}, "0123456789", false, http.StatusOK},
+		{"declared length over the limit", route{}, "0123456789x", false, http.StatusRequestEntityTooLarge},
+		{"chunked body over the limit", route{}, "0123456789x", true, http.StatusRequestEntityTooLarge},
+		{"buffered for retries and over the limit", route{Retry: &retry_policy{MaxAttempts: 2}}, "0123456789x", true, http.StatusRequestEntityTooLarge},
+		{"route limit wins", route{MaxBodySize: 20}, "0123456789x", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.Copy(io.Discard, r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+			}))
+			defer upstream.Close()
+			conf := proxy_to(t, upstream, tt.route)
+			conf.MaxBodySize = 10
+			gateway := httptest.NewServer(http.HandlerFunc(proxyHandler))
+			defer gateway.Close()
+
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body) // Hides the length from NewRequest
+			}
+			request, _ := http.NewRequest("POST", gateway.URL+"/upload", body)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d", response.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestStreamingFlush(t *testing.T) {
+	tests := []struct {
+		name         string
+		content_type string
+	}{
+		{"event stream", "text/event-stream"},
+		{"unknown length", "application/x-ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finish := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.content_type)
+				io.WriteString(w, "first\n")
+				w.(http.Flusher).Flush()
+				<-finish // Holds the rest back until the client saw the first line
+				io.WriteString(w, "second\n")
+			}))
+			defer upstream.Close()
+			defer close(finish)
+			proxy_to(t, upstream, route{})
+			gateway := httptest.NewServer(http.HandlerFunc(proxyHandler))
+			defer gateway.Close()
+
+			line := make(chan string, 1)
+			go func() {
+				response, err := http.Get(gateway.URL + "/events")
+				if err != nil {
+					line <- err.Error()
+					return
+				}
+				defer response.Body.Close()
+				text, _ := bufio.NewReader(response.Body).ReadString('\n')
+				line <- text
+			}()
+			select {
+			case got := <-line:
+				if got != "first\n" {
+					t.Fatalf("got %q", got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("first line still stuck in a buffer")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Upstream timeouts. The top level timeouts block is the default, a route's own block overrides
+// whichever fields it sets.
+type timeout_policy struct {
+	Connect   duration `json:"connect"`    // Dialing the app server
+	FirstByte duration `json:"first_byte"` // From sending the request to the response headers, per attempt
+	Total     duration `json:"total"`      // Whole request including queueing, retries and the response body
+}
+
+// Timeouts on the client side connections. Only read at startup.
+// Proxied requests get their route's total timeout instead, see extend_deadlines.
+type server_timeouts struct {
+	ReadHeader duration `json:"read_header"`
+	Read       duration `json:"read"`  // Whole request including the body
+	Write      duration `json:"write"` // From the end of the request headers to the end of the response
+	Idle       duration `json:"idle"`  // Keep-alive connections waiting for the next request
+}
+
+// Remaining time budget sent to the app servers, e.g. "2.5s", so they can give up when nobody is waiting.
+// A shorter one sent by the client is passed on as is.
+const deadline_header = "X-Request-Timeout"
+
+func (tp *timeout_policy) validate() error {
+	if tp.Connect < 0 || tp.FirstByte < 0 || tp.Total < 0 {
+		return errors.New("timeouts can't be negative")
+	}
+	return nil
+}
+
+// Route timeouts with the gateway defaults filled in
+func (c *gateway_config) timeouts_for(rt *route) timeout_policy {
+	tp := c.Timeouts
+	if rt.Timeouts == nil {
+		return tp
+	}
+	if rt.Timeouts.Connect > 0 {
+		tp.Connect = rt.Timeouts.Connect
+	}
+	if rt.Timeouts.FirstByte > 0 {
+		tp.FirstByte = rt.Timeouts.FirstByte
+	}
+	if rt.Timeouts.Total > 0 {
+		tp.Total = rt.Timeouts.Total
+	}
+	return tp
+}
+
+// Context for the whole request: the route's total timeout, or the client's own deadline if that is sooner
+func request_context(ctx context.Context, r *http.Request, tp timeout_policy) (context.Context, context.CancelFunc) {
+	total := time.Duration(tp.Total)
+	if asked, err := time.ParseDuration(r.Header.Get(deadline_header)); err == nil && asked > 0 && (total == 0 || asked < total) {
+		total = asked
+	}
+	if total == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, total)
+}
+
+// Tells the upstream how long it has left
+func set_deadline_header(ctx context.Context, req *http.Request) {
+	req.Header.Del(deadline_header)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(deadline_header, time.Until(deadline).Round(time.Millisecond).String())
+	}
+}
+
+// One client per connect/first byte/TLS combination, each with its own connection pool
+var upstream_clients sync.Map
+
+type upstream_client_key struct {
+	connect, first_byte duration
+	tls                 upstream_tls_config
+}
+
+func upstream_client_for(c *gateway_config, tp timeout_policy) *http.Client {
+	key := upstream_client_key{tp.Connect, tp.FirstByte, c.UpstreamTLS}
+	if client, ok := upstream_clients.Load(key); ok {
+		return client.(*http.Client)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: time.Duration(tp.Connect), KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = time.Duration(tp.FirstByte)
+	transport.TLSClientConfig = c.upstream_tls
+	client := &http.Client{
+		Transport: otelhttp.NewTransport(transport), // Injects trace headers
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Redirects are the client's business, not ours
+		},
+	}
+	actual, _ := upstream_clients.LoadOrStore(key, client)
+	return actual.(*http.Client)
+}
+
+// Builds a listener's server with the configured client side timeouts
+func new_http_server(addr string, handler http.Handler, st server_timeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(st.ReadHeader),
+		ReadTimeout:       time.Duration(st.Read),
+		WriteTimeout:      time.Duration(st.Write),
+		IdleTimeout:       time.Duration(st.Idle),
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPS settings of a listener. Without certificates the listener speaks plain HTTP.
+type tls_listener_config struct {
+	Certificates []certificate_config `json:"certificates"` // Picked by SNI, the first one is the fallback
+	MinVersion   string               `json:"min_version"`  // 1.0, 1.1, 1.2 (default) or 1.3
+	CipherSuites []string             `json:"cipher_suites"`
+	ClientCAFile string               `json:"client_ca_file"` // Asks clients for a certificate signed by these CAs, see control.require_client_cert
+}
+
+type certificate_config struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+var tls_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// How often certificate files are checked for changes
+const certificate_poll = 5 * time.Second
+
+func (l *listener_config) uses_tls() bool {
+	return len(l.TLS.Certificates) > 0
+}
+
+func (l *listener_config) validate() error {
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return fmt.Errorf("bad addr %q: %w", l.Addr, err)
+	}
+	if l.RedirectTo != "" {
+		if l.uses_tls() || l.H2C {
+			return errors.New("a redirect listener can't also have tls or h2c")
+		}
+		if _, _, err := net.SplitHostPort(l.RedirectTo); err != nil {
+			return fmt.Errorf("bad redirect_to %q, want something like :443", l.RedirectTo)
+		}
+	}
+	if !l.uses_tls() {
+		if l.TLS.MinVersion != "" || len(l.TLS.CipherSuites) > 0 || l.TLS.ClientCAFile != "" {
+			return errors.New("tls settings without certificates")
+		}
+		return nil
+	}
+	for _, c := range l.TLS.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return errors.New("every certificate needs cert_file and key_file")
+		}
+	}
+	if _, err := l.TLS.tls_version(); err != nil {
+		return err
+	}
+	if _, err := l.TLS.cipher_suites(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (tc *tls_listener_config) tls_version() (uint16, error) {
+	if tc.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tls_versions[tc.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls min_version %q", tc.MinVersion)
+	}
+	return version, nil
+}
+
+// Only suites Go considers secure are accepted. They only apply up to TLS 1.2, 1.3 picks its own.
+func (tc *tls_listener_config) cipher_suites() ([]uint16, error) {
+	if len(tc.CipherSuites) == 0 {
+		return nil, nil // Go's defaults
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(tc.CipherSuites))
+	for _, name := range tc.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Certificates of one listener, swapped as a whole when the files change on disk
+type certificate_store struct {
+	files    []certificate_config
+	loaded   atomic.Pointer[loaded_certificates]
+	mod_time time.Time // Newest mtime among the files at the last load
+}
+
+type loaded_certificates struct {
+	by_name  map[string]*tls.Certificate // Lower cased DNS names, wildcards kept as "*.example.com"
+	fallback *tls.Certificate
+}
+
+func new_certificate_store(files []certificate_config) (*certificate_store, error) {
+	store := &certificate_store{files: files}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	go store.watch()
+	return store, nil
+}
+
+func (cs *certificate_store) load() error {
+	newest := cs.newest_mod_time()
+	loaded := &loaded_certificates{by_name: make(map[string]*tls.Certificate)}
+	for _, f := range cs.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", f.CertFile, err)
+		}
+		if loaded.fallback == nil {
+			loaded.fallback = &cert
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName} // Old certificates without SANs
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, taken := loaded.by_name[name]; !taken {
+				loaded.by_name[name] = &cert // Earlier entries win
+			}
+		}
+	}
+	cs.loaded.Store(loaded)
+	cs.mod_time = newest
+	return nil
+}
+
+func (cs *certificate_store) newest_mod_time() time.Time {
+	var newest time.Time
+	for _, f := range cs.files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+				newest = info.ModTime()
+			}
+		}
+	}
+	return newest
+}
+
+// Picks up renewed certificates. A bad set of files is logged and the old certificates stay.
+func (cs *certificate_store) watch() {
+	for range time.Tick(certificate_poll) {
+		if !cs.newest_mod_time().After(cs.mod_time) {
+			continue
+		}
+		if err := cs.load(); err != nil {
+			log.Printf("[ERROR] Certificate reload failed, keeping the old ones: %v", err)
+			cs.mod_time = cs.newest_mod_time() // Don't retry until the files change again
+			continue
+		}
+		log.Printf("Reloaded certificates %s", cs.files[0].CertFile)
+	}
+}
+
+// SNI lookup: exact name, then a wildcard one level up, then the fallback
+func (cs *certificate_store) get_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loaded := cs.loaded.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := loaded.by_name[name]; ok {
+		return cert, nil
+	}
+	if _, parent, found := strings.Cut(name, "."); found {
+		if cert, ok := loaded.by_name["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return loaded.fallback, nil
+}
+
+// Sends everything to the same host and path over HTTPS
+func redirect_handler(https_addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(https_addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(request_host(r), "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// Runs one listener until it fails
+func serve_listener(l listener_config, handler http.Handler, st server_timeouts) error {
+	if l.RedirectTo != "" {
+		handler = redirect_handler(l.RedirectTo)
+	}
+	server := new_http_server(l.Addr, handler, st)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(l.uses_tls() && !l.DisableHTTP2)
+	protocols.SetUnencryptedHTTP2(l.H2C) // HTTP/2 with prior knowledge, for clients inside the network
+	server.Protocols = &protocols
+
+	if !l.uses_tls() {
+		return server.ListenAndServe()
+	}
+	store, err := new_certificate_store(l.TLS.Certificates)
+	if err != nil {
+		return err
+	}
+	version, _ := l.TLS.tls_version()  // Checked by validate
+	suites, _ := l.TLS.cipher_suites() // Same
+	server.TLSConfig = &tls.Config{
+		GetCertificate: store.get_certificate,
+		MinVersion:     version,
+		CipherSuites:   suites,
+	}
+	if l.TLS.ClientCAFile != "" {
+		pool, err := load_ca_pool(l.TLS.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		// Optional so ordinary clients still get through, the control endpoints check for it
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return server.ListenAndServeTLS("", "")
+}